@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// attributePrecedences are the precedence levels an attribute path may be
+// prefixed with, e.g. "override:memory.total". The prefix becomes the first
+// element of the attribute path, so the value is read from that level of
+// the node object instead of the merged attributes. Partial search only
+// sees the merged attributes, so such paths make the exporter fetch whole
+// node objects; see readsPrecedence.
+var attributePrecedences = map[string]bool{
+	"default":   true,
+	"normal":    true,
+	"override":  true,
+	"automatic": true,
+}
+
+// readsPrecedence reports whether any of the partial search paths in params
+// reads a single precedence level.
+func readsPrecedence(params map[string]interface{}) bool {
+	for _, path := range params {
+		if p := path.([]string); len(p) > 1 && attributePrecedences[p[0]] {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedKeys are the partial search keys requested by the exporter itself
+// and the names of its own node metrics, including those of the attributes
+// exported under a fixed name.
+var reservedKeys = map[string]bool{
+	"name":                          true,
+	"policy_name":                   true,
+	"policy_group":                  true,
+	"status":                        true,
+	"ohai_time":                     true,
+	"time_since_ohai_seconds":       true,
+	"chef_version":                  true,
+	"chef_environment":              true,
+	"roles":                         true,
+	"node_id":                       true,
+	"stale":                         true,
+	"group_by":                      true,
+	"ipaddress":                     true,
+	"ohai_time_present":             true,
+	"info":                          true,
+	"metadata":                      true,
+	"scrape_timestamp_seconds":      true,
+	"attribute_coverage":            true,
+	"last_report_timestamp_seconds": true,
+	"ohai_age_seconds":              true,
+	"coverage_ratio":                true,
+	"last_run_duration_seconds":     true,
+	"compliance_passed":             true,
+	"compliance_failed":             true,
+}
+
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// nodeAttribute is a node attribute requested via partial search and
+// exported as a per-node gauge.
+type nodeAttribute struct {
+	// key is both the partial search result key and the metric name suffix.
+	key    string
+	path   []string
+	help   string
+	metric *prometheus.GaugeVec
+	// boolean attributes are exported as 1 (true) or 0 (false).
+	boolean bool
+	// count attributes may also be lists or maps, exported as their
+	// number of elements, e.g. a list of passed compliance controls.
+	count bool
+	// defaultValue, if set, is exported for nodes missing the attribute.
+	defaultValue *float64
+}
+
+// parseAttribute turns an attribute path such as "memory.total" or
+// "override:memory.total" into a nodeAttribute. Without a precedence prefix
+// the merged value of the attribute is used.
+func parseAttribute(s string) (*nodeAttribute, error) {
+	path, err := parseAttributePath(s)
+	if err != nil {
+		return nil, err
+	}
+	key := invalidMetricChars.ReplaceAllString(strings.Join(path, "_"), "_")
+	return &nodeAttribute{
+		key:  key,
+		path: path,
+		help: "Value of the node attribute " + strings.Join(path, "."),
+	}, nil
+}
+
+// newNamedAttribute is like parseAttribute, but exports the attribute under
+// a fixed metric name.
+func newNamedAttribute(name string, s string, help string) (*nodeAttribute, error) {
+	path, err := parseAttributePath(s)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeAttribute{
+		key:  name,
+		path: path,
+		help: help,
+	}, nil
+}
+
+// parseAttributePath splits an attribute path into its partial search path.
+func parseAttributePath(s string) ([]string, error) {
+	var path []string
+	if i := strings.Index(s, ":"); i >= 0 {
+		precedence := s[:i]
+		if !attributePrecedences[precedence] {
+			return nil, fmt.Errorf("unknown attribute precedence %q in %q", precedence, s)
+		}
+		path = append(path, precedence)
+		s = s[i+1:]
+	}
+	for _, p := range strings.Split(s, ".") {
+		if p == "" {
+			return nil, fmt.Errorf("invalid attribute path %q", s)
+		}
+		path = append(path, p)
+	}
+	return path, nil
+}
+
+// parseAttributes parses a comma separated list of attribute paths.
+func parseAttributes(s string) ([]*nodeAttribute, error) {
+	var attributes []*nodeAttribute
+	if s == "" {
+		return attributes, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		a, err := parseAttribute(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		if reservedKeys[a.key] {
+			return nil, fmt.Errorf("attribute %q is already exported", p)
+		}
+		attributes = append(attributes, a)
+	}
+	return attributes, nil
+}
+
+// parseBoolAttributes parses a comma separated list of boolean attribute
+// paths.
+func parseBoolAttributes(s string) ([]*nodeAttribute, error) {
+	attributes, err := parseAttributes(s)
+	for _, a := range attributes {
+		a.boolean = true
+	}
+	return attributes, err
+}
+
+// setAttributeDefaults parses a comma separated list of path=value pairs
+// and sets them as the default values of the matching attributes.
+func setAttributeDefaults(s string, attributes []*nodeAttribute) error {
+	if s == "" {
+		return nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		i := strings.LastIndex(p, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid attribute default %q, expected path=value", p)
+		}
+		path, err := parseAttributePath(strings.TrimSpace(p[:i]))
+		if err != nil {
+			return err
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(p[i+1:]), 64)
+		if err != nil {
+			return fmt.Errorf("invalid attribute default %q: %v", p, err)
+		}
+		found := false
+		for _, attr := range attributes {
+			if strings.Join(attr.path, ".") == strings.Join(path, ".") {
+				attr.defaultValue = &value
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("attribute default %q is not for an exported attribute", p)
+		}
+	}
+	return nil
+}
+
+// maxInfoLabels caps the number of -chef.info-labels.
+const maxInfoLabels = 10
+
+// parseInfoLabels parses a comma separated list of attribute paths exported
+// as labels of chef_node_info. The label names are the attribute keys.
+func parseInfoLabels(s string) ([]*nodeAttribute, error) {
+	var labels []*nodeAttribute
+	if s == "" {
+		return labels, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		a, err := parseAttribute(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, a)
+	}
+	if len(labels) > maxInfoLabels {
+		return nil, fmt.Errorf("%d info labels configured, at most %d are allowed", len(labels), maxInfoLabels)
+	}
+	return labels, nil
+}
+
+// infoLabelValue formats an attribute value as a label value.
+func infoLabelValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// nodeAttributeValue looks up an attribute path in a full node object. Paths
+// starting with a precedence level are read from that level, others from
+// the node's top-level fields (name, chef_environment, ...) or else from the
+// attributes merged in Chef's precedence order.
+func nodeAttributeValue(node map[string]interface{}, path []string) interface{} {
+	if attributePrecedences[path[0]] || len(path) == 1 && node[path[0]] != nil {
+		return lookupPath(node, path)
+	}
+	for _, precedence := range []string{"automatic", "override", "normal", "default"} {
+		if v := lookupPath(node, append([]string{precedence}, path...)); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// lookupPath returns the value at path in nested maps, or nil.
+func lookupPath(v interface{}, path []string) interface{} {
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+// value converts a partial search result value to a float. Numeric strings
+// are accepted as Ohai reports some numbers as strings.
+func (a *nodeAttribute) value(v interface{}) (float64, bool) {
+	if a.boolean {
+		b, ok := v.(bool)
+		if !ok {
+			return 0, false
+		}
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case []interface{}:
+		return float64(len(v)), a.count
+	case map[string]interface{}:
+		return float64(len(v)), a.count
+	}
+	return 0, false
+}
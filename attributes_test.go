@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttributePrecedence(t *testing.T) {
+	attributes, err := parseAttributes("memory.total, override:memory.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/organizations/precedence/search/node", func(w http.ResponseWriter, r *http.Request) {
+		// Partial search only sees the merged attributes.
+		if r.Method != "GET" {
+			t.Errorf("got a %s search, want a search for whole nodes", r.Method)
+		}
+		node := map[string]interface{}{
+			"name":     "web01",
+			"default":  map[string]interface{}{"memory": map[string]interface{}{"total": "4"}},
+			"override": map[string]interface{}{"memory": map[string]interface{}{"total": "8"}},
+			"automatic": map[string]interface{}{
+				"ohai_time": float64(time.Now().Unix()) - 100,
+				"memory":    map[string]interface{}{"total": "16"},
+			},
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": 1, "start": 0, "rows": []interface{}{node}})
+	})
+	e := newTestExporter(t, stub.URL+"/organizations/precedence", ExporterOpts{Attributes: attributes})
+	mfs := gather(t, e)
+
+	if v := gaugeValue(t, mfs, "chef_node_memory_total", map[string]string{"node": "web01"}); v != 16 {
+		t.Errorf("got merged memory of %v, want the automatic 16", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_node_override_memory_total", map[string]string{"node": "web01"}); v != 8 {
+		t.Errorf("got override memory of %v, want 8", v)
+	}
+
+	if _, err := parseAttributes("forced:memory.total"); err == nil {
+		t.Error("unknown precedence accepted")
+	}
+}
+
+func TestLastRunDuration(t *testing.T) {
+	a, err := newNamedAttribute("last_run_duration_seconds", "chef_client.run_time", "Duration of the last chef-client run in seconds.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "slow", "last_run_duration_seconds": 412.5},
+		map[string]interface{}{"name": "unknown"},
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: []*nodeAttribute{a}})
+	mfs := gather(t, e)
+
+	if v := gaugeValue(t, mfs, "chef_node_last_run_duration_seconds", map[string]string{"node": "slow"}); v != 412.5 {
+		t.Errorf("got a run duration of %v, want 412.5", v)
+	}
+	if m := findMetric(mfs, "chef_node_last_run_duration_seconds", map[string]string{"node": "unknown"}); m != nil {
+		t.Errorf("node without a run duration exported %v", m)
+	}
+}
+
+func TestBoolAttributes(t *testing.T) {
+	attributes, err := parseBoolAttributes("compliance.ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "good", "compliance_ok": true},
+		map[string]interface{}{"name": "bad", "compliance_ok": false},
+		map[string]interface{}{"name": "odd", "compliance_ok": "yes"},
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes})
+	mfs := gather(t, e)
+
+	for node, want := range map[string]float64{"good": 1, "bad": 0} {
+		if v := gaugeValue(t, mfs, "chef_node_compliance_ok", map[string]string{"node": node}); v != want {
+			t.Errorf("got %v for %s, want %v", v, node, want)
+		}
+	}
+	if m := findMetric(mfs, "chef_node_compliance_ok", map[string]string{"node": "odd"}); m != nil {
+		t.Errorf("non-boolean value exported as %v", m)
+	}
+	if v := gaugeValue(t, mfs, "chef_exporter_parse_failures_total", nil); v != 1 {
+		t.Errorf("got %v parse failures, want 1", v)
+	}
+}
+
+func TestAttributeKeyConflicts(t *testing.T) {
+	for _, path := range []string{"name", "ohai_age_seconds", "last_run_duration_seconds", "compliance_passed", "compliance_failed"} {
+		if _, err := parseAttributes(path); err == nil {
+			t.Errorf("attribute %s accepted, though the exporter exports it", path)
+		}
+	}
+
+	attrs, err := parseAttributes("memory.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	boolAttrs, err := parseBoolAttributes("memory.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	duration, err := newNamedAttribute("last_run_duration_seconds", "chef_client.run_time", "Duration of the last chef-client run in seconds.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passed, err := newNamedAttribute("last_run_duration_seconds", "audit.passed", "Number of compliance controls that passed on the node.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t)
+	for _, attributes := range [][]*nodeAttribute{append(attrs, boolAttrs...), {duration, passed}} {
+		_, err := NewExporter(ExporterOpts{ChefServerURL: stub.URL + "/", ChefClientName: "test", ChefClientKey: testKeyFile(t), Attributes: attributes})
+		if err == nil {
+			t.Errorf("attributes %s and %s exported under the same name", attributes[0].path, attributes[1].path)
+		}
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	attributes, err := parseAttributes("memory.total, memroy.free")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "web01", "memory_total": "16"},
+		map[string]interface{}{"name": "web02"},
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes})
+	missing, err := e.validateAttributes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, []string{"memroy.free"}) {
+		t.Errorf("got missing attributes %v, want only the misspelt memroy.free", missing)
+	}
+}
+
+func TestFullNodes(t *testing.T) {
+	attributes, err := parseAttributes("filesystem.by_mountpoint./.percent_used")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/organizations/full/search/node", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			// Partial search doesn't return this attribute.
+			stub.search(w, r)
+			return
+		}
+		node := map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+			"automatic": map[string]interface{}{
+				"ohai_time": float64(time.Now().Unix()) - 100,
+				"filesystem": map[string]interface{}{"by_mountpoint": map[string]interface{}{
+					"/": map[string]interface{}{"percent_used": "42"},
+				}},
+			},
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": 1, "start": 0, "rows": []interface{}{node}})
+	})
+	stub.setRows(map[string]interface{}{"name": "web01", "ohai_time": float64(time.Now().Unix()) - 100})
+
+	for _, full := range []bool{false, true} {
+		e := newTestExporter(t, stub.URL+"/organizations/full", ExporterOpts{Attributes: attributes, FullNodes: full})
+		mfs := gather(t, e)
+		if v := gaugeValue(t, mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "web01"}); v < 100 || v > 110 {
+			t.Errorf("full=%t: got an Ohai age of %v, want about 100", full, v)
+		}
+		m := findMetric(mfs, "chef_node_filesystem_by_mountpoint___percent_used", map[string]string{"node": "web01"})
+		if full && (m == nil || m.Gauge.GetValue() != 42) {
+			t.Errorf("full node search didn't export the attribute: %v", m)
+		}
+		if !full && m != nil {
+			t.Errorf("partial search exported %v", m)
+		}
+	}
+}
+
+func TestComplianceAttributes(t *testing.T) {
+	var attributes []*nodeAttribute
+	for name, path := range map[string]string{"compliance_passed": "audit.passed", "compliance_failed": "audit.failed"} {
+		a, err := newNamedAttribute(name, path, "Number of compliance controls.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.count = true
+		attributes = append(attributes, a)
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "audited", "compliance_passed": []interface{}{"c1", "c2", "c3"}, "compliance_failed": float64(1)},
+		map[string]interface{}{"name": "unaudited"},
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes})
+	mfs := gather(t, e)
+
+	for name, want := range map[string]float64{"chef_node_compliance_passed": 3, "chef_node_compliance_failed": 1} {
+		if v := gaugeValue(t, mfs, name, map[string]string{"node": "audited"}); v != want {
+			t.Errorf("got %s %v, want %v", name, v, want)
+		}
+		if m := findMetric(mfs, name, map[string]string{"node": "unaudited"}); m != nil {
+			t.Errorf("node without audit data exported %s", name)
+		}
+	}
+}
+
+func TestInfoLabels(t *testing.T) {
+	info, err := parseInfoLabels("chef_environment, platform, kernel.release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t, map[string]interface{}{
+		"name":                "web01",
+		"ohai_time":           float64(time.Now().Unix()),
+		"info_platform":       "ubuntu",
+		"info_kernel_release": "5.15.0",
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{InfoLabels: info})
+	mfs := gather(t, e)
+
+	want := map[string]string{"node": "web01", "platform": "ubuntu", "kernel_release": "5.15.0", "chef_environment": ""}
+	m := findMetric(mfs, "chef_node_info", map[string]string{"node": "web01"})
+	if m == nil || m.Gauge.GetValue() != 1 {
+		t.Fatalf("got chef_node_info %v, want 1", m)
+	}
+	if len(m.Label) != len(want) {
+		t.Errorf("got labels %v, want %v", m.Label, want)
+	}
+	// Nodes missing an attribute get an empty label value.
+	if findMetric(mfs, "chef_node_info", want) == nil {
+		t.Errorf("got labels %v, want %v", m.Label, want)
+	}
+
+	var many []string
+	for i := 0; i <= maxInfoLabels; i++ {
+		many = append(many, "attr"+strconv.Itoa(i))
+	}
+	if _, err := parseInfoLabels(strings.Join(many, ",")); err == nil {
+		t.Errorf("%d info labels accepted", len(many))
+	}
+}
+
+func TestAttributeDefaults(t *testing.T) {
+	attributes, err := parseAttributes("memory.total, memory.free")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setAttributeDefaults("memory.total=0", attributes); err != nil {
+		t.Fatal(err)
+	}
+	if err := setAttributeDefaults("cpu.total=0", attributes); err == nil {
+		t.Error("default for an attribute that isn't exported accepted")
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "full", "memory_total": 16, "memory_free": 8},
+		map[string]interface{}{"name": "partial"},
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes})
+	mfs := gather(t, e)
+
+	if v := gaugeValue(t, mfs, "chef_node_memory_total", map[string]string{"node": "full"}); v != 16 {
+		t.Errorf("got %v for full, want 16", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_node_memory_total", map[string]string{"node": "partial"}); v != 0 {
+		t.Errorf("got %v for the missing attribute, want the default 0", v)
+	}
+	if m := findMetric(mfs, "chef_node_memory_free", map[string]string{"node": "partial"}); m != nil {
+		t.Errorf("missing attribute without a default exported as %v", m)
+	}
+}
+
+func TestRequestedAttributes(t *testing.T) {
+	attributes, err := parseAttributes("memory.total, override:cpu.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoLabels, err := parseInfoLabels("memory.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t, node("web01", 100))
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes, InfoLabels: infoLabels})
+	mfs := gather(t, e)
+
+	requested := map[string]bool{}
+	for _, mf := range mfs {
+		if mf.GetName() != "chef_exporter_requested_attribute" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			requested[m.Label[0].GetValue()] = true
+		}
+	}
+	for _, path := range []string{"name", "ohai_time", "memory.total", "override.cpu.total"} {
+		if !requested[path] {
+			t.Errorf("%s missing from chef_exporter_requested_attribute %v", path, requested)
+		}
+	}
+	if v := gaugeValue(t, mfs, "chef_exporter_requested_attributes_total", nil); v != float64(len(requested)) {
+		t.Errorf("got chef_exporter_requested_attributes_total %v, want %d", v, len(requested))
+	}
+}
+
+func TestAttributeCoverage(t *testing.T) {
+	attributes, err := parseAttributes("memory.total, cpu.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "n1", "memory_total": 16, "cpu_total": 4},
+		map[string]interface{}{"name": "n2", "memory_total": 16},
+		map[string]interface{}{"name": "n3", "memory_total": 32},
+		map[string]interface{}{"name": "n4"},
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes})
+	mfs := gather(t, e)
+	for attribute, want := range map[string]float64{"memory.total": 0.75, "cpu.total": 0.25} {
+		if v := gaugeValue(t, mfs, "chef_node_attribute_coverage", map[string]string{"attribute": attribute}); v != want {
+			t.Errorf("got a coverage of %v for %s, want %v", v, attribute, want)
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	group, err := parseAttribute("kernel.machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withGroup := func(name string, age float64, value string) map[string]interface{} {
+		n := node(name, age)
+		n["group_by"] = value
+		return n
+	}
+	stub := newChefStub(t,
+		withGroup("web01", 100, "x86_64"),
+		withGroup("web02", 300, "x86_64"),
+		withGroup("arm01", 600, "aarch64"),
+		map[string]interface{}{"name": "new", "group_by": "aarch64"},
+		node("other", 100),
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{GroupBy: group, GroupByMaxValues: 10, GroupByAges: true})
+	mfs := gather(t, e)
+	labels := func(value string) map[string]string {
+		return map[string]string{"group_attribute": "kernel.machine", "value": value}
+	}
+	for value, want := range map[string]float64{"x86_64": 2, "aarch64": 2, "": 1} {
+		if v := gaugeValue(t, mfs, "chef_nodes_by_group", labels(value)); v != want {
+			t.Errorf("got %v nodes for %q, want %v", v, value, want)
+		}
+	}
+	for value, want := range map[string][2]float64{"x86_64": {200, 100}, "aarch64": {600, 600}} {
+		if v := gaugeValue(t, mfs, "chef_group_mean_ohai_age_seconds", labels(value)); math.Abs(v-want[0]) > 5 {
+			t.Errorf("got a mean age of %v for %q, want %v", v, value, want[0])
+		}
+		if v := gaugeValue(t, mfs, "chef_group_newest_ohai_age_seconds", labels(value)); math.Abs(v-want[1]) > 5 {
+			t.Errorf("got a newest age of %v for %q, want %v", v, value, want[1])
+		}
+	}
+
+	e = newTestExporter(t, stub.URL, ExporterOpts{GroupBy: group, GroupByMaxValues: 2})
+	buf := captureLog(t)
+	mfs = gather(t, e)
+	if m := findMetric(mfs, "chef_nodes_by_group", labels("")); m != nil {
+		t.Errorf("value beyond -chef.group-by-max-values counted as %v", m)
+	}
+	if m := findMetric(mfs, "chef_group_mean_ohai_age_seconds", labels("x86_64")); m != nil {
+		t.Errorf("got a mean age of %v without -chef.group-by-ages", m)
+	}
+	if !strings.Contains(buf.String(), "1 nodes with other values are not counted") {
+		t.Errorf("no warning about the capped values:\n%s", buf)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops the exporter from querying the Chef server after
+// repeated failures. Once threshold consecutive scrapes have failed, the
+// breaker opens and scrapes are skipped until cooldown has passed. The next
+// scrape is then let through as a probe: if it succeeds the breaker closes,
+// otherwise it opens again for another cooldown period.
+//
+// A threshold of 0 disables the breaker. The breaker is not safe for
+// concurrent use; the exporter only uses it while holding its mutex.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a scrape may query the Chef server at now.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.failures++
+	if b.threshold > 0 && (b.state == breakerHalfOpen || b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
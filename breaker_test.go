@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+	now := time.Now()
+
+	b.failure(now)
+	if b.state != breakerClosed || !b.allow(now) {
+		t.Fatal("breaker opened below the threshold")
+	}
+	b.failure(now)
+	if b.state != breakerOpen {
+		t.Fatal("breaker still closed at the threshold")
+	}
+	if b.allow(now.Add(30 * time.Second)) {
+		t.Error("breaker allowed a scrape during the cooldown")
+	}
+
+	// A failed probe opens the breaker for another cooldown period.
+	if !b.allow(now.Add(time.Minute)) || b.state != breakerHalfOpen {
+		t.Fatal("breaker didn't let a probe through after the cooldown")
+	}
+	b.failure(now.Add(time.Minute))
+	if b.state != breakerOpen || b.allow(now.Add(90*time.Second)) {
+		t.Fatal("breaker didn't reopen after a failed probe")
+	}
+
+	if !b.allow(now.Add(2 * time.Minute)) {
+		t.Fatal("breaker didn't let a probe through after the second cooldown")
+	}
+	b.success()
+	if b.state != breakerClosed || b.failures != 0 {
+		t.Errorf("breaker in state %d with %d failures after a successful probe", b.state, b.failures)
+	}
+}
+
+func TestCircuitBreakerSkipsScrapes(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/organizations/down/search/node", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+	e := newTestExporter(t, stub.URL+"/organizations/down", ExporterOpts{BreakerThreshold: 1, BreakerCooldown: time.Hour})
+
+	gather(t, e)
+	requests := len(stub.paths())
+	if requests == 0 {
+		t.Fatal("first scrape didn't query the Chef server")
+	}
+	mfs := gather(t, e)
+	if n := len(stub.paths()); n != requests {
+		t.Errorf("open breaker let %d requests through", n-requests)
+	}
+	if v := gaugeValue(t, mfs, "chef_up", nil); v != 0 {
+		t.Errorf("got chef_up %v with the breaker open, want 0", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_exporter_circuit_state", nil); v != breakerOpen {
+		t.Errorf("got chef_exporter_circuit_state %v, want %d", v, breakerOpen)
+	}
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-chef/chef"
@@ -17,15 +33,80 @@ import (
 
 const (
 	namespace = "chef" // For Prometheus metrics.
+
+	// maxPageHalvings caps how often a scrape halves the search page size.
+	maxPageHalvings = 4
+
+	// maxLastSearchBytes caps the rows kept for /debug/last-search.
+	maxLastSearchBytes = 4 << 20
+
+	// maxInfoLabelValues is the number of distinct values of an info label
+	// above which a scrape warns about its cardinality.
+	maxInfoLabelValues = 1000
 )
 
+// nodeGroup aggregates the nodes sharing a value of -chef.group-by.
+type nodeGroup struct {
+	nodes  int
+	aged   int
+	ageSum float64
+	minAge float64
+}
+
 type metrics map[int]*prometheus.GaugeVec
 
 var (
 	nodeLabelNames = []string{"node"}
+	semverRegexp   = regexp.MustCompile(`^(\d+)\.\d+\.\d+`)
+	// optionalNodeLabels are the labels -chef.node-labels can add to the
+	// node metrics besides node.
+	optionalNodeLabels = map[string]bool{"policy_name": true, "policy_group": true, "ip_family": true}
+)
+
+// Scrape error categories, as reported by chef_exporter_last_scrape_error.
+const (
+	errorKey         = "key"
+	errorClient      = "client"
+	errorSearch      = "search"
+	errorCircuitOpen = "circuit_open"
+	errorCardinality = "cardinality_limit"
+	errorDuplicate   = "duplicate_nodes"
+	errorEmpty       = "empty"
+	errorMaintenance = "maintenance"
 )
 
-func newNodeMetric(metricName string, docString string, constLabels prometheus.Labels) *prometheus.GaugeVec {
+var scrapeErrorCategories = []string{errorKey, errorClient, errorSearch, errorCircuitOpen, errorCardinality, errorDuplicate, errorEmpty, errorMaintenance}
+
+// Policies for rows sharing a node label, as set by -chef.dedup.
+const (
+	dedupKeepFreshest = "keep-freshest"
+	dedupKeepFirst    = "keep-first"
+	dedupError        = "error"
+)
+
+// What to do with the per-node metrics when a scrape fails, as set by
+// -metric.on-failure.
+const (
+	onFailureClear     = "clear"
+	onFailureRetain    = "retain"
+	onFailureMarkStale = "mark-stale"
+)
+
+// scrapeError is a failed scrape, classified by the stage that failed.
+type scrapeError struct {
+	category string
+	err      error
+}
+
+func (e *scrapeError) Error() string {
+	return e.category + ": " + e.err.Error()
+}
+
+func (e *scrapeError) Unwrap() error {
+	return e.err
+}
+
+func newNodeMetric(metricName string, docString string, labelNames []string, constLabels prometheus.Labels) *prometheus.GaugeVec {
 	return prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace:   namespace,
@@ -33,7 +114,7 @@ func newNodeMetric(metricName string, docString string, constLabels prometheus.L
 			Help:        docString,
 			ConstLabels: constLabels,
 		},
-		nodeLabelNames,
+		labelNames,
 	)
 }
 
@@ -44,35 +125,680 @@ type Exporter struct {
 	chefServerUrl               string
 	chefClientName              string
 	chefClientKey               string
+	searchQuery                 string
+	searchURL                   *url.URL
+	sinceSeconds                int
+	httpClient                  *http.Client
+	clientMutex                 sync.Mutex // Protects client, shared with the optional collectors.
+	client                      *chef.Client
+	clientRebuilds              prometheus.Counter
+	signingErrors               prometheus.Counter
 	up                          prometheus.Gauge
 	totalScrapes, ParseFailures prometheus.Counter
 	nodeMetrics                 map[int]*prometheus.GaugeVec
+	nodeStatus                  *prometheus.GaugeVec
+	nodeOhaiPresent             *prometheus.GaugeVec
+	nodeScrapeTime              *prometheus.GaugeVec
+	missingOhaiTime             prometheus.Gauge
+	maxAge                      time.Duration
+	zombieNodes                 prometheus.Gauge
+	futureNodes                 prometheus.Gauge
+	sampleFraction              float64
+	sampleScrape                int
+	sampled                     map[string]sampledNode
+	nodesMatching               prometheus.Gauge
+	maxResponseBytes            int64
+	shardIndex, shardTotal      int
+	// sampledValues, sampledBuckets and sampledAged are the aggregates
+	// counted over all nodes while sampling; see countAggregates.
+	sampledValues  map[string]map[string]bool
+	sampledBuckets map[float64]uint64
+	sampledAged    int
+	// fetchedRows and exportedNodes of the last scrape, for its summary.
+	fetchedRows, exportedNodes   int
+	oversizedResponses           prometheus.Counter
+	serverMaintenance            prometheus.Gauge
+	attributeCoverage            *prometheus.GaugeVec
+	strictDecode                 bool
+	decodeAnomalies              *prometheus.CounterVec
+	staleThreshold               time.Duration
+	staleThresholdGauge          prometheus.Gauge
+	ohaiAgeDesc                  *prometheus.Desc
+	requestedAttributesDesc      *prometheus.Desc
+	oldestAgeDesc, newestAgeDesc *prometheus.Desc
+	agePercentileDescs           map[float64]*prometheus.Desc
+	requestedAttributeDesc       *prometheus.Desc
+	ohaiAgeBuckets               []float64
+	ohaiAges                     []float64
+	attributes                   []*nodeAttribute
+	breaker                      *circuitBreaker
+	circuitState                 prometheus.Gauge
+	stateFile                    string
+	warmState                    []stateSample
+	stateStale                   prometheus.Gauge
+	clientVersions               *prometheus.GaugeVec
+	indexLag                     prometheus.Gauge
+	scrapeRows                   prometheus.Gauge
+	searchRows                   prometheus.Gauge
+	pageSize                     int
+	checkInWindows               []checkInWindow
+	ageBuckets                   []ageBucket
+	expectedNodes                int
+	strictUp                     bool
+	sourceTimestamps             bool
+	roundSeconds                 float64
+	sourceTimes                  map[string]int64
+	infoLabels                   []*nodeAttribute
+	nodeInfo                     *prometheus.GaugeVec
+	partial                      bool
+	scrapePartial                prometheus.Gauge
+	nodesSeen                    int
+	expectedNodesGauge           prometheus.Gauge
+	coverageRatio                prometheus.Gauge
+	org                          string
+	debugLastSearch              bool
+	lastSearch                   []byte
+	lastSearchOmitted            int
+	opts                         ExporterOpts // As given to NewExporter, for nodeExporter.
+	constLabels                  prometheus.Labels
+	ohaiAgeName                  string
+	collectorDuration            *prometheus.GaugeVec
+	currentPageSize              prometheus.Gauge
+	slowestPage                  prometheus.Gauge
+	scrapePages                  prometheus.Gauge
+	maxSeries                    int
+	cardinalityLimitHits         prometheus.Counter
+	dedup                        string
+	onFailure                    string
+	unknownAge                   float64
+	lastGood                     []stateSample
+	nodeStale                    *prometheus.GaugeVec
+	allowEmpty                   bool
+	duplicateNodes               prometheus.Counter
+	lastScrapeError              *prometheus.GaugeVec
+	scrapeAllocBytes             prometheus.Gauge
+	freshestOhaiTime             float64
+	clientVersionMajor           bool
+	nodeLabelNames               []string
+	labelIPFamily                bool
+	fullNodes                    bool
+	policyGroups                 *prometheus.GaugeVec
+	environments                 prometheus.Gauge
+	roles                        prometheus.Gauge
+	nodeIDField                  []string
+	features                     *serverFeatures
+	sourceFile                   string
+	node                         string
+	// scrapeResponseBytes are the bytes of the search responses of the
+	// current scrape.
+	scrapeResponseBytes     uint64
+	lastScrapeResponseBytes prometheus.Gauge
+	groupBy                 *nodeAttribute
+	groupByMaxValues        int
+	groupByAges             bool
+	nodesByGroup            *prometheus.GaugeVec
+	groupMeanAge            *prometheus.GaugeVec
+	groupNewestAge          *prometheus.GaugeVec
+}
+
+// ExporterOpts holds the settings of an Exporter.
+type ExporterOpts struct {
+	ChefServerURL      string
+	SearchURL          string
+	ChefClientName     string
+	ChefClientKey      string
+	SearchQuery        string
+	SinceSeconds       int
+	HTTPClient         *http.Client
+	OhaiAgeBuckets     []float64
+	Attributes         []*nodeAttribute
+	BreakerThreshold   int
+	BreakerCooldown    time.Duration
+	StateFile          string
+	ClientVersionMajor bool
+	LabelPolicy        bool
+	LabelIPFamily      bool
+	// NodeLabels, if set, are the labels of the node metrics in order,
+	// instead of the ones enabled by LabelPolicy and LabelIPFamily.
+	NodeLabels     []string
+	FullNodes      bool
+	StaleThreshold time.Duration
+	MaxSeries      int
+	NodeIDField    []string
+	ConstLabels    prometheus.Labels
+	PageSize       int
+	CheckInWindows []checkInWindow
+	AgeBuckets     []ageBucket
+	ExpectedNodes  int
+	StrictUp       bool
+	Dedup          string
+	OnFailure      string
+	// UnknownAge is the age exported for nodes without ohai_time, NaN if
+	// nil.
+	UnknownAge       *float64
+	AllowEmpty       bool
+	MaxAge           time.Duration
+	LegacyNames      bool
+	SampleFraction   float64
+	MaxResponseBytes int64
+	StrictDecode     bool
+	ShardIndex       int
+	ShardTotal       int
+	SourceTimestamps bool
+	RoundSeconds     float64
+	InfoLabels       []*nodeAttribute
+	GroupBy          *nodeAttribute
+	// SourceFile, if set, is read for the search rows instead of querying
+	// the Chef server.
+	SourceFile string
+	// Node, if set, restricts the rows to the node with that node label
+	// value, as for /metrics?node=. The search query must match it.
+	Node              string
+	GroupByMaxValues  int
+	GroupByAges       bool
+	DebugLastSearch   bool
+	CollectorDuration *prometheus.GaugeVec
 }
 
-func NewExporter(uri string, chefClientName string, chefClientKey string) (*Exporter, error) {
-	return &Exporter{
-		chefServerUrl:  uri,
-		chefClientName: chefClientName,
-		chefClientKey:  chefClientKey,
+func NewExporter(opts ExporterOpts) (*Exporter, error) {
+	if opts.SearchQuery == "" {
+		opts.SearchQuery = "*:*"
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = 1000
+	}
+	if opts.OnFailure == "" {
+		opts.OnFailure = onFailureClear
+	}
+	if opts.SampleFraction <= 0 || opts.SampleFraction > 1 {
+		opts.SampleFraction = 1
+	}
+	// Metric names before they got unit suffixes, for -metric.legacy-names.
+	ohaiAgeName, scrapesName, parseFailuresName := "time_since_ohai_seconds", "exporter_scrapes_total", "exporter_parse_failures_total"
+	if opts.LegacyNames {
+		ohaiAgeName, scrapesName, parseFailuresName = "ohai_time", "exporter_total_scrapes", "exporter_parse_failures"
+	}
+	labelNames := append([]string{}, nodeLabelNames...)
+	if opts.LabelPolicy {
+		labelNames = append(labelNames, "policy_name", "policy_group")
+	}
+	if opts.LabelIPFamily {
+		labelNames = append(labelNames, "ip_family")
+	}
+	if len(opts.NodeLabels) > 0 {
+		labelNames = append([]string{}, opts.NodeLabels...)
+	}
+	labelIPFamily := false
+	for _, name := range labelNames {
+		labelIPFamily = labelIPFamily || name == "ip_family"
+	}
+	infoLabelNames := append([]string{}, labelNames...)
+	for _, l := range opts.InfoLabels {
+		for _, name := range infoLabelNames {
+			if l.key == name {
+				return nil, fmt.Errorf("info label %q is already a node label", l.key)
+			}
+		}
+		infoLabelNames = append(infoLabelNames, l.key)
+	}
+	statusLabelNames := labelNames
+	if len(opts.AgeBuckets) > 0 {
+		statusLabelNames = append(append([]string{}, labelNames...), "age_bucket")
+	}
+	e := &Exporter{
+		opts:             opts,
+		chefServerUrl:    opts.ChefServerURL,
+		chefClientName:   opts.ChefClientName,
+		chefClientKey:    opts.ChefClientKey,
+		searchQuery:      opts.SearchQuery,
+		sinceSeconds:     opts.SinceSeconds,
+		httpClient:       opts.HTTPClient,
+		ohaiAgeBuckets:   opts.OhaiAgeBuckets,
+		nodeLabelNames:   labelNames,
+		labelIPFamily:    labelIPFamily,
+		pageSize:         opts.PageSize,
+		ageBuckets:       opts.AgeBuckets,
+		expectedNodes:    opts.ExpectedNodes,
+		strictUp:         opts.StrictUp,
+		sourceTimestamps: opts.SourceTimestamps,
+		roundSeconds:     opts.RoundSeconds,
+		sourceTimes:      map[string]int64{},
+		infoLabels:       opts.InfoLabels,
+		nodeInfo:         newNodeMetric("info", "Always 1. The labels carry the node attributes selected with -chef.info-labels.", infoLabelNames, opts.ConstLabels),
+		scrapePartial: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "scrape_partial",
+			Help:        "1 if the last scrape only got part of the nodes because a search page failed.",
+		}),
+		expectedNodesGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_expected",
+			Help:        "Expected number of nodes, as set by -chef.expected-nodes.",
+		}),
+		coverageRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "node_coverage_ratio",
+			Help:        "Number of nodes returned by the last search divided by -chef.expected-nodes.",
+		}),
+		org:               opts.ConstLabels["org"],
+		debugLastSearch:   opts.DebugLastSearch,
+		constLabels:       opts.ConstLabels,
+		ohaiAgeName:       ohaiAgeName,
+		collectorDuration: opts.CollectorDuration,
+		nodeIDField:       opts.NodeIDField,
+		features:          newServerFeatures(opts.ConstLabels),
+		sourceFile:        opts.SourceFile,
+		node:              opts.Node,
+		lastScrapeResponseBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_last_scrape_response_bytes",
+			Help:        "Bytes of the search response bodies of the last scrape, after decompression.",
+		}),
+		groupBy:          opts.GroupBy,
+		groupByMaxValues: opts.GroupByMaxValues,
+		groupByAges:      opts.GroupByAges,
+		nodesByGroup: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_by_group",
+			Help:        "Number of nodes per value of the -chef.group-by attribute. Nodes without it have an empty value.",
+		}, []string{"group_attribute", "value"}),
+		groupMeanAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "group_mean_ohai_age_seconds",
+			Help:        "Average time since Ohai was last run across the nodes with the value of the -chef.group-by attribute.",
+		}, []string{"group_attribute", "value"}),
+		groupNewestAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "group_newest_ohai_age_seconds",
+			Help:        "Smallest time since Ohai was last run across the nodes with the value of the -chef.group-by attribute.",
+		}, []string{"group_attribute", "value"}),
+		fullNodes:          opts.FullNodes,
+		breaker:            newCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		stateFile:          opts.StateFile,
+		clientVersionMajor: opts.ClientVersionMajor,
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Was the last scrape successful.",
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "up",
+			Help:        "Was the last scrape successful.",
 		}),
 		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "exporter_total_scrapes",
-			Help:      "Current total scrapes.",
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        scrapesName,
+			Help:        "Number of scrapes of the Chef server.",
 		}),
 		ParseFailures: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "exporter_parse_failures",
-			Help:      "Number of errors while fetching metrics.",
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        parseFailuresName,
+			Help:        "Number of node attribute values that couldn't be converted to a number.",
+		}),
+		circuitState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_circuit_state",
+			Help:        "State of the Chef server circuit breaker (0 = closed, 1 = open, 2 = half-open).",
+		}),
+		clientRebuilds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_client_rebuilds_total",
+			Help:        "Number of times the Chef client was rebuilt after an authentication failure.",
+		}),
+		signingErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_signing_errors_total",
+			Help:        "Number of times the client key couldn't be used to sign requests, e.g. because it isn't a valid RSA key. A valid key the server rejects counts as a client rebuild instead.",
+		}),
+		stateStale: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_state_stale",
+			Help:        "1 if the node metrics are the last known values restored from the state file.",
+		}),
+		clientVersions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_by_client_version",
+			Help:        "Number of nodes per chef-client version.",
+		}, []string{"version"}),
+		indexLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "search_index_lag_seconds",
+			Help:        "Time since the most recent ohai_time found in the search index. A large lag suggests the index is not being updated.",
+		}),
+		lastScrapeError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_last_scrape_error",
+			Help:        "1 for the category of the error that made the last scrape fail, 0 for the others.",
+		}, []string{"category"}),
+		maxSeries: opts.MaxSeries,
+		cardinalityLimitHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_cardinality_limit_hits_total",
+			Help:        "Number of scrapes whose per-node series were dropped for exceeding -chef.max-series.",
+		}),
+		dedup:      opts.Dedup,
+		onFailure:  opts.OnFailure,
+		unknownAge: math.NaN(),
+		nodeStale:  newNodeMetric("stale", "1 if the values of the node are from the last successful scrape, as the last scrape failed.", labelNames, opts.ConstLabels),
+		allowEmpty: opts.AllowEmpty,
+		duplicateNodes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_duplicate_nodes_total",
+			Help:        "Number of search rows sharing their node label with an earlier row of the same scrape.",
+		}),
+		scrapeRows: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_scrape_peak_rows",
+			Help:        "Number of search result rows processed by the last scrape.",
+		}),
+		searchRows: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "search_result_rows",
+			Help:        "Number of rows returned by the Chef server for the node search of the last scrape.",
+		}),
+		currentPageSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_current_page_size",
+			Help:        "Search page size used at the end of the last scrape. Below -chef.page-size after failed pages were retried with fewer rows.",
+		}),
+		scrapePages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_last_scrape_pages",
+			Help:        "Number of search pages fetched by the last scrape. Failed pages are not counted.",
+		}),
+		slowestPage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_search_slowest_page_seconds",
+			Help:        "Duration of the slowest search page of the last scrape.",
+		}),
+		scrapeAllocBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_scrape_alloc_bytes",
+			Help:        "Bytes allocated by the exporter during the last scrape.",
+		}),
+		policyGroups: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_by_policy_group",
+			Help:        "Number of nodes per policy group. Nodes not using Policyfiles are not counted.",
+		}, []string{"policy_group"}),
+		environments: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "environments_total",
+			Help:        "Number of distinct environments the nodes belong to.",
+		}),
+		roles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "roles_total",
+			Help:        "Number of distinct roles in the expanded run lists of the nodes.",
+		}),
+		staleThreshold: opts.StaleThreshold,
+		staleThresholdGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_stale_threshold_seconds",
+			Help:        "Ohai age above which chef_node_status reports a node as stale.",
+		}),
+		nodeStatus:      newNodeMetric("status", "1 if Ohai ran on the node within the stale threshold, 0 otherwise.", statusLabelNames, opts.ConstLabels),
+		nodeOhaiPresent: newNodeMetric("ohai_time_present", "1 if the node has an ohai_time attribute, 0 if Ohai never ran on it.", labelNames, opts.ConstLabels),
+		nodeScrapeTime:  newNodeMetric("scrape_timestamp_seconds", "Time of the last scrape that returned the node.", labelNames, opts.ConstLabels),
+		missingOhaiTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_missing_ohai_time",
+			Help:        "Number of nodes without an ohai_time attribute.",
+		}),
+		maxAge: opts.MaxAge,
+		zombieNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_zombie_total",
+			Help:        "Number of nodes whose Ohai age exceeds -chef.max-age-seconds. They have no per-node series.",
+		}),
+		futureNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_future_ohai_total",
+			Help:        "Number of nodes whose ohai_time is in the future, usually because their clock is ahead. Their age is exported as 0.",
+		}),
+		maxResponseBytes: opts.MaxResponseBytes,
+		shardIndex:       opts.ShardIndex,
+		shardTotal:       opts.ShardTotal,
+		oversizedResponses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_oversized_responses_total",
+			Help:        "Number of Chef API responses discarded for exceeding -chef.max-response-bytes.",
+		}),
+		serverMaintenance: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "server_maintenance",
+			Help:        "1 if the Chef server answered the last search with 503 Service Unavailable, as it does in maintenance mode during upgrades.",
+		}),
+		attributeCoverage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "node_attribute_coverage",
+			Help:        "Share of the nodes returned by the search that have a value for the attribute.",
+		}, []string{"attribute"}),
+		strictDecode: opts.StrictDecode,
+		decodeAnomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "exporter_decode_anomalies_total",
+			Help:        "Number of unexpected search rows and fields found, by kind. Rows that can't be used are always counted, the other anomalies only with -chef.strict-decode.",
+		}, []string{"kind"}),
+		sampleFraction: opts.SampleFraction,
+		sampled:        map[string]sampledNode{},
+		sampledValues:  map[string]map[string]bool{},
+		nodesMatching: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_matching",
+			Help:        "Number of nodes matching the search query, including those not fetched with -chef.sample-fraction.",
 		}),
 		nodeMetrics: map[int]*prometheus.GaugeVec{
-			0: newNodeMetric("ohai_time", "The time at which Ohai was last run", nil),
+			0: newNodeMetric(ohaiAgeName, "Seconds since Ohai last ran on the node.", labelNames, opts.ConstLabels),
 		},
-	}, nil
+		ohaiAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "node", "ohai_age_seconds"),
+			"Distribution of the time since Ohai was last run across all nodes.",
+			nil, opts.ConstLabels,
+		),
+		oldestAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "fleet", "oldest_ohai_age_seconds"),
+			"Largest time since Ohai was last run across all nodes.",
+			nil, opts.ConstLabels,
+		),
+		newestAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "fleet", "newest_ohai_age_seconds"),
+			"Smallest time since Ohai was last run across all nodes.",
+			nil, opts.ConstLabels,
+		),
+		agePercentileDescs: map[float64]*prometheus.Desc{},
+		requestedAttributesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "requested_attributes_total"),
+			"Number of node attributes requested by the node search.",
+			nil, opts.ConstLabels,
+		),
+		requestedAttributeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "requested_attribute"),
+			"Always 1. The attribute label is the path of a node attribute requested by the node search.",
+			[]string{"attribute"}, opts.ConstLabels,
+		),
+	}
+	for _, p := range ohaiAgePercentiles {
+		e.agePercentileDescs[p] = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "fleet", fmt.Sprintf("ohai_age_p%g_seconds", p*100)),
+			fmt.Sprintf("%gth percentile of the time since Ohai was last run across the nodes of the last scrape. It is computed from that scrape alone, not over a time window.", p*100),
+			nil, opts.ConstLabels,
+		)
+	}
+	if opts.UnknownAge != nil {
+		e.unknownAge = *opts.UnknownAge
+	}
+	// Each exporter gets its own attribute metrics, as the ones exporting
+	// a single node must not reset the fleet-wide ones.
+	e.staleThresholdGauge.Set(opts.StaleThreshold.Seconds())
+	// Attributes from different flags may end up with the same key, such
+	// as a path given to both -chef.attributes and -chef.bool-attributes.
+	keys := map[string]string{}
+	for _, a := range opts.Attributes {
+		path := strings.Join(a.path, ".")
+		if other, ok := keys[a.key]; ok {
+			return nil, fmt.Errorf("attributes %s and %s are both exported as %s_node_%s", other, path, namespace, a.key)
+		}
+		keys[a.key] = path
+	}
+	for _, a := range opts.Attributes {
+		a := *a
+		a.metric = newNodeMetric(a.key, a.help, labelNames, opts.ConstLabels)
+		e.attributes = append(e.attributes, &a)
+	}
+	for _, w := range opts.CheckInWindows {
+		w.gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: opts.ConstLabels,
+			Name:        "nodes_checked_in_last_" + w.name,
+			Help:        fmt.Sprintf("Number of nodes that ran Ohai within the last %s.", w.window),
+		})
+		e.checkInWindows = append(e.checkInWindows, w)
+	}
+	if opts.SearchURL != "" {
+		u, err := url.Parse(opts.SearchURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid search URL: %w", err)
+		}
+		e.searchURL = u
+	}
+	if !e.fullNodes && readsPrecedence(e.searchParams()) {
+		log.Print("Fetching whole node objects, as partial search can't read attributes of a single precedence level")
+		e.fullNodes = true
+	}
+	if e.stateFile != "" {
+		samples, err := readState(e.stateFile)
+		if err == nil {
+			e.warmState = samples
+		} else if !os.IsNotExist(err) {
+			log.Print("Couldn't read state file: ", err)
+		}
+	}
+	return e, nil
+}
+
+// parseBuckets parses a comma separated list of histogram upper bounds.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", f, err)
+		}
+		buckets = append(buckets, b)
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		return nil, fmt.Errorf("buckets %q are not in increasing order", s)
+	}
+	return buckets, nil
+}
+
+// checkInWindow counts the nodes that ran Ohai within a window, exported
+// as chef_nodes_checked_in_last_<name>.
+type checkInWindow struct {
+	name   string
+	window time.Duration
+	gauge  prometheus.Gauge
+}
+
+// parseCheckInWindows parses durations such as "1h" or "90m". The duration
+// as given is used in the metric name.
+func parseCheckInWindows(values []string) ([]checkInWindow, error) {
+	var windows []checkInWindow
+	for _, v := range values {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid check-in window %q", v)
+		}
+		windows = append(windows, checkInWindow{name: invalidMetricChars.ReplaceAllString(v, "_"), window: d})
+	}
+	return windows, nil
+}
+
+// ageBucket is a range of Ohai ages, used as the age_bucket label of
+// chef_node_status.
+type ageBucket struct {
+	label string
+	upper time.Duration
+}
+
+// parseAgeBuckets parses increasing durations such as "1h,6h,24h" into the
+// buckets <1h, 1h-6h, 6h-24h and >24h.
+func parseAgeBuckets(s string) ([]ageBucket, error) {
+	var buckets []ageBucket
+	prev := ""
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		d, err := time.ParseDuration(f)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid age bucket %q", f)
+		}
+		if len(buckets) > 0 && d <= buckets[len(buckets)-1].upper {
+			return nil, fmt.Errorf("age buckets %q are not in increasing order", s)
+		}
+		label := "<" + f
+		if prev != "" {
+			label = prev + "-" + f
+		}
+		buckets = append(buckets, ageBucket{label: label, upper: d})
+		prev = f
+	}
+	return append(buckets, ageBucket{label: ">" + prev, upper: time.Duration(math.MaxInt64)}), nil
+}
+
+// ageBucketLabel returns the label of the bucket holding the age in seconds.
+func (e *Exporter) ageBucketLabel(age float64) string {
+	if math.IsNaN(age) {
+		return "unknown"
+	}
+	for _, b := range e.ageBuckets {
+		if age <= b.upper.Seconds() {
+			return b.label
+		}
+	}
+	return e.ageBuckets[len(e.ageBuckets)-1].label
+}
+
+// roundAge rounds the age in seconds to the -metric.round-seconds
+// granularity, so sub-second noise doesn't change every sample.
+func (e *Exporter) roundAge(age float64) float64 {
+	if e.roundSeconds <= 0 {
+		return age
+	}
+	return math.Round(age/e.roundSeconds) * e.roundSeconds
 }
 
 // Describe describes all the metrics ever exported by the HAProxy exporter. It
@@ -81,9 +807,73 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.nodeMetrics {
 		m.Describe(ch)
 	}
+	for _, a := range e.attributes {
+		a.metric.Describe(ch)
+	}
+	e.clientVersions.Describe(ch)
+	e.nodeStatus.Describe(ch)
+	e.nodeOhaiPresent.Describe(ch)
+	e.nodeScrapeTime.Describe(ch)
+	if e.onFailure == onFailureMarkStale {
+		e.nodeStale.Describe(ch)
+	}
+	if len(e.infoLabels) > 0 {
+		e.nodeInfo.Describe(ch)
+	}
+	ch <- e.missingOhaiTime.Desc()
+	ch <- e.zombieNodes.Desc()
+	ch <- e.futureNodes.Desc()
+	ch <- e.nodesMatching.Desc()
+	ch <- e.staleThresholdGauge.Desc()
+	e.policyGroups.Describe(ch)
+	ch <- e.environments.Desc()
+	if e.groupBy != nil {
+		e.nodesByGroup.Describe(ch)
+		if e.groupByAges {
+			e.groupMeanAge.Describe(ch)
+			e.groupNewestAge.Describe(ch)
+		}
+	}
+	if e.expectedNodes > 0 {
+		ch <- e.expectedNodesGauge.Desc()
+		ch <- e.coverageRatio.Desc()
+	}
+	for _, w := range e.checkInWindows {
+		ch <- w.gauge.Desc()
+	}
+	ch <- e.roles.Desc()
+	ch <- e.indexLag.Desc()
+	ch <- e.ohaiAgeDesc
+	ch <- e.oldestAgeDesc
+	ch <- e.newestAgeDesc
+	for _, d := range e.agePercentileDescs {
+		ch <- d
+	}
+	ch <- e.requestedAttributesDesc
+	ch <- e.requestedAttributeDesc
 	ch <- e.up.Desc()
+	ch <- e.scrapePartial.Desc()
 	ch <- e.totalScrapes.Desc()
 	ch <- e.ParseFailures.Desc()
+	ch <- e.circuitState.Desc()
+	ch <- e.stateStale.Desc()
+	ch <- e.clientRebuilds.Desc()
+	ch <- e.signingErrors.Desc()
+	ch <- e.scrapeRows.Desc()
+	ch <- e.searchRows.Desc()
+	ch <- e.currentPageSize.Desc()
+	ch <- e.slowestPage.Desc()
+	ch <- e.scrapePages.Desc()
+	ch <- e.cardinalityLimitHits.Desc()
+	ch <- e.duplicateNodes.Desc()
+	ch <- e.oversizedResponses.Desc()
+	ch <- e.serverMaintenance.Desc()
+	e.features.Describe(ch)
+	e.attributeCoverage.Describe(ch)
+	e.decodeAnomalies.Describe(ch)
+	e.lastScrapeError.Describe(ch)
+	ch <- e.scrapeAllocBytes.Desc()
+	ch <- e.lastScrapeResponseBytes.Desc()
 }
 
 // Collect fetches the stats from configured HAProxy location and delivers them
@@ -93,103 +883,1702 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	defer e.mutex.Unlock()
 
 	e.resetMetrics()
-	e.scrape()
+	now := time.Now()
+	var err error
+	if !e.breaker.allow(now) {
+		err = &scrapeError{errorCircuitOpen, errors.New("too many failed scrapes, not querying the Chef server")}
+	} else if err = e.collectNodes(ch); e.partial {
+		log.Print("Scrape partially failed: ", err)
+		e.breaker.success()
+	} else if err != nil {
+		log.Print("Scrape failed: ", err)
+		// The Chef server answered, it's the results that are too big.
+		var serr *scrapeError
+		if !errors.As(err, &serr) || serr.category != errorCardinality {
+			e.breaker.failure(now)
+		}
+	} else {
+		e.breaker.success()
+		e.saveState()
+		if e.onFailure != onFailureClear {
+			e.lastGood = e.snapshot()
+		}
+	}
+	e.setScrapeError(err)
+	e.circuitState.Set(float64(e.breaker.state))
+
+	// Until the first successful scrape, serve the values of the state
+	// file instead of nothing.
+	e.stateStale.Set(0)
+	if e.warmState != nil {
+		e.restore(e.warmState)
+		e.stateStale.Set(1)
+	} else if err != nil && !e.partial && e.lastGood != nil {
+		e.retainLastGood(err)
+	}
 
 	ch <- e.up
+	ch <- e.scrapePartial
 	ch <- e.totalScrapes
 	ch <- e.ParseFailures
+	ch <- e.circuitState
+	ch <- e.stateStale
+	ch <- e.clientRebuilds
+	ch <- e.signingErrors
+	ch <- e.scrapeRows
+	ch <- e.searchRows
+	ch <- e.currentPageSize
+	ch <- e.slowestPage
+	ch <- e.scrapePages
+	ch <- e.scrapeAllocBytes
+	ch <- e.lastScrapeResponseBytes
+	ch <- e.cardinalityLimitHits
+	ch <- e.duplicateNodes
+	ch <- e.oversizedResponses
+	ch <- e.serverMaintenance
+	e.features.Collect(ch)
+	e.decodeAnomalies.Collect(ch)
+	e.lastScrapeError.Collect(ch)
 	e.collectMetrics(ch)
 }
 
+// retainLastGood serves the per-node values of the last successful scrape
+// after the scrape failed with err, unless -metric.on-failure=clear. With
+// mark-stale, the nodes also get chef_node_stale. A scrape over the
+// -chef.max-series limit drops the per-node metrics on purpose, so they
+// aren't retained.
+func (e *Exporter) retainLastGood(err error) {
+	var serr *scrapeError
+	if errors.As(err, &serr) && serr.category == errorCardinality {
+		return
+	}
+	e.restore(e.lastGood)
+	if e.onFailure != onFailureMarkStale {
+		return
+	}
+	for _, s := range e.lastGood {
+		if s.Metric == "ohai_time_present" {
+			if g, err := e.nodeStale.GetMetricWith(s.Labels); err == nil {
+				g.Set(1)
+			}
+		}
+	}
+}
+
+// setScrapeError updates chef_up and chef_exporter_last_scrape_error from
+// the result of a scrape.
+func (e *Exporter) setScrapeError(err error) {
+	category := ""
+	var serr *scrapeError
+	if errors.As(err, &serr) {
+		category = serr.category
+	}
+	for _, c := range scrapeErrorCategories {
+		if c == category {
+			e.lastScrapeError.WithLabelValues(c).Set(1)
+		} else {
+			e.lastScrapeError.WithLabelValues(c).Set(0)
+		}
+	}
+	if err != nil && !e.partial {
+		e.up.Set(0)
+	} else {
+		e.up.Set(1)
+	}
+	if e.partial {
+		e.scrapePartial.Set(1)
+	} else {
+		e.scrapePartial.Set(0)
+	}
+}
+
+// saveState writes the node metrics to the state file after a successful
+// scrape and drops the warm-start values.
+func (e *Exporter) saveState() {
+	e.warmState = nil
+	if e.stateFile == "" {
+		return
+	}
+	if err := writeState(e.stateFile, e.snapshot()); err != nil {
+		log.Print("Couldn't write state file: ", err)
+	}
+}
+
 func (e *Exporter) resetMetrics() {
 	for _, m := range e.nodeMetrics {
 		m.Reset()
 	}
+	for _, a := range e.attributes {
+		a.metric.Reset()
+	}
+	e.clientVersions.Reset()
+	e.nodeStatus.Reset()
+	e.nodeOhaiPresent.Reset()
+	e.nodeScrapeTime.Reset()
+	e.nodeStale.Reset()
+	e.nodeInfo.Reset()
+	e.missingOhaiTime.Set(0)
+	e.zombieNodes.Set(0)
+	e.futureNodes.Set(0)
+	e.nodesMatching.Set(0)
+	e.policyGroups.Reset()
+	e.environments.Set(0)
+	e.nodesByGroup.Reset()
+	e.groupMeanAge.Reset()
+	e.groupNewestAge.Reset()
+	for _, w := range e.checkInWindows {
+		w.gauge.Set(0)
+	}
+	e.roles.Set(0)
+	e.freshestOhaiTime = 0
+	e.scrapeRows.Set(0)
+	e.searchRows.Set(0)
+	e.nodesSeen = -1
+	e.fetchedRows, e.exportedNodes = 0, 0
+	e.serverMaintenance.Set(0)
+	e.attributeCoverage.Reset()
+	e.partial = false
+	e.sourceTimes = map[string]int64{}
+	e.ohaiAges = e.ohaiAges[:0]
+	e.sampledBuckets, e.sampledAged = nil, 0
 }
 
-func (e *Exporter) scrape() {
+// collectNodes runs the node scrape and counts it.
+func (e *Exporter) collectNodes(ch chan<- prometheus.Metric) error {
 	e.totalScrapes.Inc()
-	key, err := ioutil.ReadFile(e.chefClientKey)
-	if err != nil {
-		fmt.Println("Couldn't read chef client key", err)
+	// prometheus.Collector has no context of its own.
+	return runCollector(context.Background(), e, nodeCollector{e}, ch)
+}
+
+// nodeCollector is the apiCollector of the node search. Its metrics are
+// kept by the exporter, which sends them once it restored the values of
+// earlier scrapes where needed, so Collect doesn't send them itself.
+type nodeCollector struct {
+	exporter *Exporter
+}
+
+// Name implements apiCollector.
+func (c nodeCollector) Name() string {
+	return "node"
+}
+
+// Describe implements apiCollector.
+func (c nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+// usesClient implements clientUser: -chef.source=file needs no client.
+func (c nodeCollector) usesClient() bool {
+	return c.exporter.sourceFile == ""
+}
+
+// Collect implements apiCollector. It runs the scrape and records the
+// memory it allocated.
+func (c nodeCollector) Collect(ctx context.Context, client *chef.Client, _ chan<- prometheus.Metric) error {
+	e := c.exporter
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	e.scrapeResponseBytes = 0
+	err := e.scrape(ctx, client)
+	took := time.Since(start)
+	e.lastScrapeResponseBytes.Set(float64(atomic.LoadUint64(&e.scrapeResponseBytes)))
+	runtime.ReadMemStats(&after)
+	e.scrapeAllocBytes.Set(float64(after.TotalAlloc - before.TotalAlloc))
+	up := 0
+	if err == nil || e.partial {
+		up = 1
 	}
+	log.Printf("Scrape complete: collector=%s nodes=%d skipped=%d duration=%.3fs up=%d partial=%t",
+		e.collectorLabel(c.Name()), e.exportedNodes, e.fetchedRows-e.exportedNodes, took.Seconds(), up, e.partial)
+	return err
+}
 
-	// build a client
-	client, err := chef.NewClient(&chef.Config{
-		Name: e.chefClientName,
-		Key:  string(key),
-		// goiardi is on port 4545 by default. chef-zero is 8889
-		BaseURL: e.chefServerUrl,
-	})
-	if err != nil {
-		fmt.Println("Issue setting up chef client:", err)
+// scrape runs the node search with client, which is nil with
+// -chef.source=file.
+func (e *Exporter) scrape(ctx context.Context, client *chef.Client) error {
+	var pres chef.SearchResult
+	var err error
+	if e.sourceFile != "" {
+		if pres, err = readSearchFile(e.sourceFile); err != nil {
+			return &scrapeError{errorSearch, fmt.Errorf("couldn't read -chef.file: %w", err)}
+		}
+	} else {
+		debugf("Searching nodes with query %q", e.nodeQuery(time.Now()))
+		pres, err = e.searchNodes(ctx, e.searchClient(client))
 	}
-	log.Print("Partial Search")
-	part := make(map[string]interface{})
-	part["ohai_time"] = []string{"ohai_time"}
-	part["name"] = []string{"name"}
-	pres, err := client.Search.PartialExec("node", "*:*", part)
+	if e.node != "" {
+		pres.Rows = nodeRows(pres.Rows, e.node)
+		pres.Total = len(pres.Rows)
+	}
+	e.searchRows.Set(float64(len(pres.Rows)))
+	e.nodesSeen = len(pres.Rows)
+	e.fetchedRows = len(pres.Rows)
+	if e.debugLastSearch {
+		e.lastSearch, e.lastSearchOmitted = capRows(pres.Rows, maxLastSearchBytes)
+	}
+	// Unless -chef.strict-up is set, the rows fetched before a search
+	// page failed are exported, and the scrape is flagged as partial.
+	var partialErr error
 	if err != nil {
-		log.Fatal("Error running Search.PartialExec()", err)
+		e.checkAuth(err)
+		serr := &scrapeError{errorSearch, fmt.Errorf("node search failed: %w", err)}
+		if inMaintenance(err) {
+			serr.category = errorMaintenance
+			e.serverMaintenance.Set(1)
+		}
+		if e.strictUp || len(pres.Rows) == 0 {
+			return serr
+		}
+		partialErr = serr
+	}
+	if e.strictDecode {
+		pres.Rows = e.checkRows(pres.Rows)
+	} else {
+		pres.Rows = e.dropMalformedRows(pres.Rows)
+	}
+	if pres.Rows, err = e.dedupNodes(pres.Rows); err != nil {
+		return err
+	}
+	if e.shardTotal > 1 {
+		pres.Rows = e.shardNodes(pres.Rows)
+	}
+	e.nodesSeen = len(pres.Rows)
+	if e.sampleFraction < 1 {
+		e.nodesSeen = pres.Total
+	}
+	e.nodesMatching.Set(float64(pres.Total))
+	if len(pres.Rows) == 0 && !e.allowEmpty {
+		return &scrapeError{errorEmpty, errors.New("the search returned no nodes")}
 	}
 
+	e.scrapeRows.Set(float64(len(pres.Rows)))
+	var scrapeErr error
+	perNode := true
+	perNodeSeries := 4 + len(e.attributes)
+	if len(e.infoLabels) > 0 {
+		perNodeSeries++
+	}
+	if series := len(pres.Rows) * perNodeSeries; e.maxSeries > 0 && series > e.maxSeries {
+		log.Printf("WARNING: the search returned %d nodes, which would export %d series, more than -chef.max-series=%d. Only exporting aggregates, check the search query!", len(pres.Rows), series, e.maxSeries)
+		e.cardinalityLimitHits.Inc()
+		scrapeErr = &scrapeError{errorCardinality, fmt.Errorf("%d series over the limit of %d", series, e.maxSeries)}
+		perNode = false
+	}
+	environments := map[string]bool{}
+	checkedIn := make([]int, len(e.checkInWindows))
+	roles := map[string]bool{}
+	missing := 0
+	zombies := 0
+	future := 0
+	clamped := 0
+	withValue := make([]int, len(e.attributes))
+	groups := map[string]*nodeGroup{}
+	ungrouped := 0
+	infoValues := make([]map[string]bool, len(e.infoLabels))
+	for i := range infoValues {
+		infoValues[i] = map[string]bool{}
+	}
+	now := time.Now()
 	for _, v := range pres.Rows {
-		sec_ago := float64(999999999)
-		data := v.(map[string]interface{})["data"].(map[string]interface{})
+		// Nodes that never ran Ohai have no age; NaN keeps them apart
+		// from very stale nodes. They are exported with -chef.unknown-age-value.
+		sec_ago := math.NaN()
+		status := 0.0
+		present := 0.0
+		data := rowData(v)
 		switch ohai_time := data["ohai_time"].(type) {
 		case float64:
+			present = 1
 			sec_ago = float64(time.Now().Unix()) - ohai_time
+			// The clock of the node is ahead of ours.
+			if sec_ago < 0 {
+				debugf("Node %v ran Ohai %.0fs in the future, using an age of 0", data["name"], -sec_ago)
+				future++
+				sec_ago = 0
+			}
+			if sec_ago <= e.staleThreshold.Seconds() {
+				status = 1
+			}
+			e.ohaiAges = append(e.ohaiAges, sec_ago)
+			for i, w := range e.checkInWindows {
+				if sec_ago <= w.window.Seconds() {
+					checkedIn[i]++
+				}
+			}
+			if ohai_time > e.freshestOhaiTime {
+				e.freshestOhaiTime = ohai_time
+			}
+		}
+		if present == 0 {
+			missing++
+		}
+		// While sampling, these are counted by searchSample.
+		if e.sampleFraction == 1 {
+			e.clientVersions.WithLabelValues(e.clientVersion(data["chef_version"])).Inc()
+			if group, ok := data["policy_group"].(string); ok && group != "" {
+				e.policyGroups.WithLabelValues(group).Inc()
+			}
+		}
+		if env, ok := data["chef_environment"].(string); ok && env != "" {
+			environments[env] = true
+		}
+		// Nodes that never converged have no roles attribute at all.
+		nodeRoles, _ := data["roles"].([]interface{})
+		for _, r := range nodeRoles {
+			if role, ok := r.(string); ok {
+				roles[role] = true
+			}
+		}
+		for i, a := range e.attributes {
+			if data[a.key] != nil {
+				withValue[i]++
+			}
+		}
+		if e.groupBy != nil {
+			value := infoLabelValue(data["group_by"])
+			g, ok := groups[value]
+			if !ok && len(groups) >= e.groupByMaxValues {
+				ungrouped++
+			} else {
+				if !ok {
+					g = &nodeGroup{minAge: math.Inf(1)}
+					groups[value] = g
+				}
+				g.nodes++
+				if present == 1 {
+					g.aged++
+					g.ageSum += sec_ago
+					g.minAge = math.Min(g.minAge, sec_ago)
+				}
+			}
+		}
+		// Decommissioned nodes that were never deleted are only counted.
+		if e.maxAge > 0 && sec_ago > e.maxAge.Seconds() {
+			zombies++
+			continue
+		}
+		if !perNode {
+			continue
+		}
+		e.exportedNodes++
+
+		labels := e.nodeLabelValues(data)
+		if ohaiTime, ok := data["ohai_time"].(float64); ok && e.sourceTimestamps {
+			ts := int64(ohaiTime * 1000)
+			if oldest := now.Add(-maxSourceTimestampAge); ts < oldest.UnixNano()/1e6 {
+				ts = oldest.UnixNano() / 1e6
+				clamped++
+			}
+			e.sourceTimes[sourceTimeKey(labels)] = ts
+		}
+		if present == 1 {
+			e.exportAttributes(e.nodeMetrics, e.roundAge(sec_ago), labels...)
+		} else {
+			e.exportAttributes(e.nodeMetrics, e.unknownAge, labels...)
+		}
+		if len(e.ageBuckets) > 0 {
+			e.nodeStatus.WithLabelValues(append(labels, e.ageBucketLabel(sec_ago))...).Set(status)
+		} else {
+			e.nodeStatus.WithLabelValues(labels...).Set(status)
+		}
+		e.nodeOhaiPresent.WithLabelValues(labels...).Set(present)
+		e.nodeScrapeTime.WithLabelValues(labels...).Set(float64(now.Unix()))
+		if len(e.infoLabels) > 0 {
+			info := append([]string{}, labels...)
+			for i, l := range e.infoLabels {
+				value := infoLabelValue(data["info_"+l.key])
+				infoValues[i][value] = true
+				info = append(info, value)
+			}
+			e.nodeInfo.WithLabelValues(info...).Set(1)
+		}
+
+		for _, a := range e.attributes {
+			if data[a.key] == nil {
+				if a.defaultValue != nil {
+					a.metric.WithLabelValues(labels...).Set(*a.defaultValue)
+				}
+				continue
+			}
+			value, ok := a.value(data[a.key])
+			if !ok {
+				e.ParseFailures.Inc()
+				continue
+			}
+			a.metric.WithLabelValues(labels...).Set(value)
+		}
+	}
+	if e.sampleFraction < 1 && perNode {
+		e.carryOverSamples()
+	}
+	if len(pres.Rows) > 0 {
+		for i, a := range e.attributes {
+			e.attributeCoverage.WithLabelValues(strings.Join(a.path, ".")).Set(float64(withValue[i]) / float64(len(pres.Rows)))
 		}
-		e.exportAttributes(e.nodeMetrics, sec_ago, data["name"].(string))
 	}
+	if e.groupBy != nil {
+		e.setGroups(groups)
+		if ungrouped > 0 {
+			log.Printf("WARNING: -chef.group-by %s has more than %d distinct values, %d nodes with other values are not counted", strings.Join(e.groupBy.path, "."), e.groupByMaxValues, ungrouped)
+		}
+	}
+	for i, l := range e.infoLabels {
+		if n := len(infoValues[i]); n > maxInfoLabelValues {
+			log.Printf("WARNING: info label %s has %d distinct values, consider dropping it from -chef.info-labels", l.key, n)
+		}
+	}
+	if clamped > 0 {
+		log.Printf("WARNING: %d nodes ran Ohai more than %s ago, their samples are timestamped %s ago instead", clamped, maxSourceTimestampAge, maxSourceTimestampAge)
+	}
+	// While sampling, these are counted by searchSample.
+	if e.sampleFraction == 1 {
+		e.missingOhaiTime.Set(float64(missing))
+		e.zombieNodes.Set(float64(zombies))
+		e.futureNodes.Set(float64(future))
+		e.environments.Set(float64(len(environments)))
+		e.roles.Set(float64(len(roles)))
+		for i, w := range e.checkInWindows {
+			w.gauge.Set(float64(checkedIn[i]))
+		}
+	}
+	if scrapeErr == nil && partialErr != nil {
+		e.partial = true
+		return partialErr
+	}
+	return scrapeErr
 }
 
-func (e *Exporter) collectMetrics(metrics chan<- prometheus.Metric) {
-	for _, m := range e.nodeMetrics {
-		m.Collect(metrics)
+// setGroups exports the -chef.group-by aggregates of a scrape. Groups
+// without a node that ran Ohai have no ages.
+func (e *Exporter) setGroups(groups map[string]*nodeGroup) {
+	attribute := strings.Join(e.groupBy.path, ".")
+	for value, g := range groups {
+		e.nodesByGroup.WithLabelValues(attribute, value).Set(float64(g.nodes))
+		if g.aged == 0 {
+			continue
+		}
+		e.groupMeanAge.WithLabelValues(attribute, value).Set(e.roundAge(g.ageSum / float64(g.aged)))
+		e.groupNewestAge.WithLabelValues(attribute, value).Set(e.roundAge(g.minAge))
 	}
 }
 
-func (e *Exporter) exportAttributes(metrics map[int]*prometheus.GaugeVec, value float64, labels ...string) {
-	for _, metric := range metrics {
-		metric.WithLabelValues(labels...).Set(value)
+// searchParams returns the partial search keys and attribute paths to
+// request for each node.
+func (e *Exporter) searchParams() map[string]interface{} {
+	part := make(map[string]interface{})
+	part["ohai_time"] = []string{"ohai_time"}
+	part["name"] = []string{"name"}
+	part["chef_version"] = []string{"chef_packages", "chef", "version"}
+	if e.features.policyfiles() {
+		part["policy_name"] = []string{"policy_name"}
+		part["policy_group"] = []string{"policy_group"}
+	}
+	part["chef_environment"] = []string{"chef_environment"}
+	part["roles"] = []string{"roles"}
+	if e.labelIPFamily {
+		part["ipaddress"] = []string{"ipaddress"}
+	}
+	for _, l := range e.infoLabels {
+		part["info_"+l.key] = l.path
+	}
+	if e.groupBy != nil {
+		part["group_by"] = e.groupBy.path
 	}
+	if e.nodeIDField != nil {
+		part["node_id"] = e.nodeIDField
+	}
+	for _, a := range e.attributes {
+		part[a.key] = a.path
+	}
+	return part
 }
 
-func main() {
-	var (
-		listenAddress  = flag.String("web.listen-address", ":9101", "Address to listen on for web interface and telemetry.")
-		metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		chefServerUrl  = flag.String("chef.url", "localhost:8080", "Chef API url.")
-		chefClientName = flag.String("chef.client-name", "chef_exporter", "Chef client name.")
-		chefClientKey  = flag.String("chef.client-keyfile", "client.pem", "Chef client keyfile.")
-		showVersion    = flag.Bool("version", false, "Print version information.")
-	)
-	flag.Parse()
-	if *showVersion {
+// validateAttributes runs a single search and returns the configured
+// attributes that are missing on every returned node, which usually means
+// the attribute path has a typo.
+func (e *Exporter) validateAttributes(ctx context.Context) ([]string, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+	pres, err := e.searchNodes(ctx, e.searchClient(client))
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, a := range e.attributes {
+		found := false
+		for _, v := range pres.Rows {
+			if data := rowData(v); data[a.key] != nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, strings.Join(a.path, "."))
+		}
+	}
+	return missing, nil
+}
+
+// nodeID returns the node label value of a row: the -chef.node-id-field
+// if set and present, the node name otherwise.
+func nodeID(data map[string]interface{}) string {
+	id, ok := data["node_id"].(string)
+	if !ok || id == "" {
+		id, _ = data["name"].(string)
+	}
+	return id
+}
+
+// nodeRows returns the rows of the node with the given node label value. A
+// search for a name or id may match other nodes, e.g. one whose name is
+// the id of another.
+func nodeRows(rows []interface{}, node string) []interface{} {
+	var matched []interface{}
+	for _, row := range rows {
+		if nodeID(rowData(row)) == node {
+			matched = append(matched, row)
+		}
+	}
+	return matched
+}
+
+// nodeLabelValues returns the values of the node metric labels for a row.
+func (e *Exporter) nodeLabelValues(data map[string]interface{}) []string {
+	id := nodeID(data)
+	values := make([]string, len(e.nodeLabelNames))
+	for i, name := range e.nodeLabelNames {
+		switch name {
+		case "node":
+			values[i] = id
+		case "policy_name", "policy_group":
+			values[i], _ = data[name].(string)
+		case "ip_family":
+			values[i] = ipFamily(data["ipaddress"])
+		}
+	}
+	return values
+}
+
+// parseNodeLabels parses a comma separated list of node metric labels as
+// given to -chef.node-labels. The node label is added first if missing.
+func parseNodeLabels(s string) ([]string, error) {
+	labels := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "node" && !optionalNodeLabels[name] {
+			return nil, fmt.Errorf("unknown node label %q, expected node, policy_name, policy_group or ip_family", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("node label %q given twice", name)
+		}
+		seen[name] = true
+		labels = append(labels, name)
+	}
+	if !seen["node"] {
+		labels = append([]string{"node"}, labels...)
+	}
+	return labels, nil
+}
+
+// dedupNodes applies the -chef.dedup policy to rows sharing a node label,
+// which would otherwise silently overwrite each other's series. This
+// happens when migrating nodes between Chef servers behind one search URL,
+// or with a -chef.node-id-field that isn't unique.
+func (e *Exporter) dedupNodes(rows []interface{}) ([]interface{}, error) {
+	index := make(map[string]int, len(rows))
+	deduped := rows[:0:0]
+	for _, v := range rows {
+		data := rowData(v)
+		id := nodeID(data)
+		i, ok := index[id]
+		if !ok {
+			index[id] = len(deduped)
+			deduped = append(deduped, v)
+			continue
+		}
+		e.duplicateNodes.Inc()
+		log.Printf("WARNING: node %s is returned more than once by the search", id)
+		switch e.dedup {
+		case dedupError:
+			return nil, &scrapeError{errorDuplicate, fmt.Errorf("node %s is returned more than once by the search", id)}
+		case dedupKeepFreshest:
+			kept := rowData(deduped[i])
+			if ohaiTime(data) > ohaiTime(kept) {
+				deduped[i] = v
+			}
+		}
+	}
+	return deduped, nil
+}
+
+// shardNodes returns the rows of the nodes in the shard of this exporter,
+// for spreading a fleet over -chef.shard-total exporters. A node belongs to
+// the shard numbered by the 32-bit FNV-1a hash of its name modulo the
+// number of shards, which doesn't depend on the other nodes. The Chef
+// server can't filter by hash, so every exporter still fetches all rows.
+func (e *Exporter) shardNodes(rows []interface{}) []interface{} {
+	shard := rows[:0:0]
+	for _, v := range rows {
+		name, _ := rowData(v)["name"].(string)
+		if nodeShard(name, e.shardTotal) == e.shardIndex {
+			shard = append(shard, v)
+		}
+	}
+	return shard
+}
+
+// nodeShard returns the shard of the node name out of total.
+func nodeShard(name string, total int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(total))
+}
+
+// ohaiTime returns the ohai_time of a node, or -Inf if it has none.
+func ohaiTime(data map[string]interface{}) float64 {
+	if t, ok := data["ohai_time"].(float64); ok {
+		return t
+	}
+	return math.Inf(-1)
+}
+
+// ipFamily returns the address family of the ipaddress attribute.
+func ipFamily(v interface{}) string {
+	s, _ := v.(string)
+	ip := net.ParseIP(s)
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
+// rowData returns the attributes of a partial search result row, or nil if
+// the row is malformed.
+func rowData(row interface{}) map[string]interface{} {
+	r, _ := row.(map[string]interface{})
+	data, _ := r["data"].(map[string]interface{})
+	return data
+}
+
+// clientVersion returns the chef_nodes_by_client_version label for a
+// chef_packages.chef.version attribute value.
+func (e *Exporter) clientVersion(v interface{}) string {
+	version, _ := v.(string)
+	m := semverRegexp.FindStringSubmatch(version)
+	if m == nil {
+		return "unknown"
+	}
+	if e.clientVersionMajor {
+		return m[1]
+	}
+	return version
+}
+
+// getClient returns the cached Chef client, building it first if needed.
+func (e *Exporter) getClient() (*chef.Client, error) {
+	e.clientMutex.Lock()
+	defer e.clientMutex.Unlock()
+	if e.client != nil {
+		return e.client, nil
+	}
+	client, err := e.newClient()
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+	return client, nil
+}
+
+// searchClient returns the client used for search requests. It shares
+// the credentials of client, but sends its requests to the search URL if
+// one is configured.
+func (e *Exporter) searchClient(client *chef.Client) *chef.Client {
+	if e.searchURL == nil {
+		return client
+	}
+	c := *client
+	c.BaseURL = e.searchURL
+	return &c
+}
+
+// checkAuth drops the cached Chef client if err is an authentication
+// failure, so the key file is read again on the next scrape. This picks up
+// rotated keys without restarting the exporter.
+func (e *Exporter) checkAuth(err error) {
+	var res *chef.ErrorResponse
+	e.clientMutex.Lock()
+	defer e.clientMutex.Unlock()
+	if errors.As(err, &res) && res.Response.StatusCode == http.StatusUnauthorized && e.client != nil {
+		log.Print("Authentication failed, rebuilding the Chef client on the next scrape")
+		e.client = nil
+		e.clientRebuilds.Inc()
+	}
+}
+
+// newClient reads the client key and builds a Chef API client.
+func (e *Exporter) newClient() (*chef.Client, error) {
+	key, err := ioutil.ReadFile(e.chefClientKey)
+	if err != nil {
+		return nil, &scrapeError{errorKey, fmt.Errorf("couldn't read chef client key: %w", err)}
+	}
+
+	client, err := chef.NewClient(&chef.Config{
+		Name: e.chefClientName,
+		Key:  string(key),
+		// goiardi is on port 4545 by default. chef-zero is 8889
+		BaseURL: e.chefServerUrl,
+	})
+	if err != nil {
+		// go-chef only fails here when the key can't be parsed for signing.
+		e.signingErrors.Inc()
+		return nil, &scrapeError{errorClient, fmt.Errorf("couldn't set up chef client: %w", err)}
+	}
+	return client, nil
+}
+
+// countNodes runs a search that returns no rows, only the number of nodes
+// known to the Chef server. It is used to validate the configuration.
+func (e *Exporter) countNodes(ctx context.Context) (int, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return 0, err
+	}
+	query := chef.SearchQuery{
+		Index:  "node",
+		Query:  e.nodeQuery(time.Now()),
+		SortBy: "X_CHEF_id_CHEF_X asc",
+		Rows:   0,
+	}
+	var res chef.SearchResult
+	if err := e.do(ctx, client, "GET", "search/"+query.String(), nil, &res); err != nil {
+		return 0, err
+	}
+	return res.Total, nil
+}
+
+// startupProbe runs countNodes for -chef.count-only. A failure is only
+// logged unless failFast is set.
+func (e *Exporter) startupProbe(ctx context.Context, failFast bool) error {
+	total, err := e.countNodes(ctx)
+	if err != nil {
+		if failFast {
+			return err
+		}
+		log.Print("Warning: startup probe failed: ", err)
+		return nil
+	}
+	log.Printf("Startup probe found %d nodes", total)
+	return nil
+}
+
+// savedSearch returns the query stored in the query field of the given data
+// bag item. Chef has no saved searches of its own, so they are kept in a
+// data bag.
+func (e *Exporter) savedSearch(ctx context.Context, bag string, name string) (string, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return "", err
+	}
+	var item struct {
+		Query string `json:"query"`
+	}
+	if err := e.do(ctx, client, "GET", "data/"+url.PathEscape(bag)+"/"+url.PathEscape(name), nil, &item); err != nil {
+		return "", err
+	}
+	if item.Query == "" {
+		return "", fmt.Errorf("data bag item %s/%s has no query", bag, name)
+	}
+	return item.Query, nil
+}
+
+// do sends a request signed by client through the exporter's own HTTP
+// client and decodes the JSON response into v.
+func (e *Exporter) do(ctx context.Context, client *chef.Client, method string, path string, body io.Reader, v interface{}) error {
+	req, err := client.NewRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	return e.send(req.WithContext(ctx), v)
+}
+
+// doSearch is do for the search requests of a scrape, whose response bytes
+// are counted in chef_exporter_last_scrape_response_bytes.
+func (e *Exporter) doSearch(ctx context.Context, client *chef.Client, method string, path string, body io.Reader, v interface{}) error {
+	req, err := client.NewRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(withResponseBytes(ctx, &e.scrapeResponseBytes))
+	return e.send(req, v)
+}
+
+// send sends a signed request through the exporter's HTTP client and
+// decodes the JSON response into v.
+func (e *Exporter) send(req *http.Request, v interface{}) error {
+	res, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	e.features.detect(res.Header)
+	if err := chef.CheckResponse(res); err != nil {
+		return err
+	}
+	return e.decodeResponse(res, v)
+}
+
+// decodeResponse decodes the JSON body of res into v, reading at most
+// -chef.max-response-bytes of it.
+func (e *Exporter) decodeResponse(res *http.Response, v interface{}) error {
+	body := io.Reader(res.Body)
+	if e.maxResponseBytes > 0 {
+		body = &limitedReader{r: res.Body, n: e.maxResponseBytes}
+	}
+	err := json.NewDecoder(body).Decode(v)
+	if errors.Is(err, errResponseTooLarge) {
+		e.oversizedResponses.Inc()
+		return fmt.Errorf("response to %s exceeds -chef.max-response-bytes=%d: %w", res.Request.URL.Path, e.maxResponseBytes, err)
+	}
+	return err
+}
+
+// errResponseTooLarge is returned when reading a Chef API response beyond
+// -chef.max-response-bytes.
+var errResponseTooLarge = errors.New("response too large")
+
+// limitedReader reads at most n bytes from r, and fails after that instead
+// of reporting EOF like io.LimitReader, so a truncated response isn't
+// mistaken for a malformed one.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// nodeQuery returns the node search query, limited to the nodes that ran
+// Ohai in the last sinceSeconds if set.
+func (e *Exporter) nodeQuery(now time.Time) string {
+	if e.sinceSeconds <= 0 {
+		return e.searchQuery
+	}
+	return fmt.Sprintf("(%s) AND ohai_time:[%d TO *]", e.searchQuery, now.Unix()-int64(e.sinceSeconds))
+}
+
+// searchNodes runs the node search page by page, returning rows in the
+// shape of a partial search result either way. With -chef.sample-fraction
+// only the sampled nodes are fetched. On error the rows fetched so far are
+// returned.
+func (e *Exporter) searchNodes(ctx context.Context, client *chef.Client) (chef.SearchResult, error) {
+	query := e.nodeQuery(time.Now())
+	s := &pagedSearch{ctx: ctx, exporter: e, client: client, pageSize: e.pageSize}
+	defer func() {
+		e.slowestPage.Set(s.slowest.Seconds())
+		e.scrapePages.Set(float64(s.pages))
+		e.currentPageSize.Set(float64(s.pageSize))
+		debugf("Search fetched %d pages, the slowest at row %d took %s", s.pages, s.slowestStart, s.slowest)
+	}()
+	if e.sampleFraction < 1 {
+		return e.searchSample(s, query)
+	}
+	return s.run(query, e.searchParams())
+}
+
+// pagedSearch runs searches page by page. When a page fails, it is retried
+// with half the page size, up to maxPageHalvings times per scrape, so a
+// slow Chef server leads to more round trips rather than a failed scrape.
+// The page size and statistics carry over between the searches of a
+// scrape.
+type pagedSearch struct {
+	ctx          context.Context
+	exporter     *Exporter
+	client       *chef.Client
+	pageSize     int
+	halvings     int
+	pages        int
+	slowest      time.Duration
+	slowestStart int
+}
+
+// run fetches all rows of a search. On error the rows fetched so far are
+// returned.
+func (s *pagedSearch) run(query string, params map[string]interface{}) (chef.SearchResult, error) {
+	var res chef.SearchResult
+	for {
+		start := time.Now()
+		page, err := s.exporter.searchPage(s.ctx, s.client, query, params, len(res.Rows), s.pageSize)
+		took := time.Since(start)
+		debugf("Search page at row %d with %d rows took %s", len(res.Rows), s.pageSize, took)
+		if took > s.slowest {
+			s.slowest, s.slowestStart = took, len(res.Rows)
+		}
+		if err != nil {
+			if s.halvings == maxPageHalvings || s.pageSize == 1 || !retryablePage(err) {
+				return res, err
+			}
+			s.halvings++
+			s.pageSize /= 2
+			log.Printf("Search page at row %d failed, retrying with %d rows: %v", len(res.Rows), s.pageSize, err)
+			continue
+		}
+		s.pages++
+		res.Total = page.Total
+		res.Rows = append(res.Rows, page.Rows...)
+		if len(page.Rows) == 0 || len(res.Rows) >= page.Total {
+			return res, nil
+		}
+	}
+}
+
+// searchPage fetches a page of the node search with partial search, or
+// whole node objects with -chef.partial-search=false.
+func (e *Exporter) searchPage(ctx context.Context, client *chef.Client, query string, params map[string]interface{}, start int, rows int) (chef.SearchResult, error) {
+	if e.fullNodes {
+		return e.fullNodeSearch(ctx, client, "node", query, params, start, rows)
+	}
+	return e.partialSearch(ctx, client, "node", query, params, start, rows)
+}
+
+// retryablePage reports whether a failed search page may succeed with
+// fewer rows. Client errors such as failed authentication will not, nor
+// will a Chef server in maintenance. Neither will an oversized response:
+// the limit is meant to fail the scrape, not to be worked around.
+func retryablePage(err error) bool {
+	if errors.Is(err, errResponseTooLarge) {
+		return false
+	}
+	var res *chef.ErrorResponse
+	if errors.As(err, &res) {
+		return res.Response.StatusCode >= 500 && !inMaintenance(err)
+	}
+	return true
+}
+
+// inMaintenance reports whether err is a 503 Service Unavailable, which the
+// Chef server front end returns for every request in maintenance mode.
+func inMaintenance(err error) bool {
+	var res *chef.ErrorResponse
+	return errors.As(err, &res) && res.Response.StatusCode == http.StatusServiceUnavailable
+}
+
+// fullNodeSearch runs a regular search returning whole node objects and
+// extracts the requested attributes from them, like partial search does on
+// the server.
+func (e *Exporter) fullNodeSearch(ctx context.Context, client *chef.Client, index string, statement string, params map[string]interface{}, start int, rows int) (res chef.SearchResult, err error) {
+	query := chef.SearchQuery{
+		Index:  index,
+		Query:  statement,
+		SortBy: "X_CHEF_id_CHEF_X asc",
+		Start:  start,
+		Rows:   rows,
+	}
+	err = e.doSearch(ctx, client, "GET", "search/"+query.String(), nil, &res)
+	if err != nil {
+		return res, err
+	}
+	for i, row := range res.Rows {
+		node, _ := row.(map[string]interface{})
+		data := make(map[string]interface{}, len(params))
+		for key, path := range params {
+			data[key] = nodeAttributeValue(node, path.([]string))
+		}
+		res.Rows[i] = map[string]interface{}{"data": data}
+	}
+	return res, nil
+}
+
+// partialSearch is the equivalent of go-chef's Search.PartialExec, sent
+// through the exporter's HTTP client.
+func (e *Exporter) partialSearch(ctx context.Context, client *chef.Client, index string, statement string, params map[string]interface{}, start int, rows int) (res chef.SearchResult, err error) {
+	query := chef.SearchQuery{
+		Index:  index,
+		Query:  statement,
+		SortBy: "X_CHEF_id_CHEF_X asc",
+		Start:  start,
+		Rows:   rows,
+	}
+	body, err := chef.JSONReader(params)
+	if err != nil {
+		return res, err
+	}
+	err = e.doSearch(ctx, client, "POST", "search/"+query.String(), body, &res)
+	return res, err
+}
+
+func (e *Exporter) collectMetrics(metrics chan<- prometheus.Metric) {
+	for _, m := range e.nodeMetrics {
+		if e.sourceTimestamps {
+			e.collectWithSourceTimestamps(m, metrics)
+		} else {
+			m.Collect(metrics)
+		}
+	}
+	for _, a := range e.attributes {
+		a.metric.Collect(metrics)
+	}
+	// The status changes with the scrape time, not with ohai_time.
+	e.nodeStatus.Collect(metrics)
+	e.nodeOhaiPresent.Collect(metrics)
+	e.nodeScrapeTime.Collect(metrics)
+	if e.onFailure == onFailureMarkStale {
+		e.nodeStale.Collect(metrics)
+	}
+	if len(e.infoLabels) > 0 {
+		e.nodeInfo.Collect(metrics)
+	}
+	metrics <- e.missingOhaiTime
+	metrics <- e.zombieNodes
+	metrics <- e.nodesMatching
+	metrics <- e.staleThresholdGauge
+	if e.expectedNodes > 0 {
+		e.expectedNodesGauge.Set(float64(e.expectedNodes))
+		metrics <- e.expectedNodesGauge
+		if e.nodesSeen >= 0 {
+			e.coverageRatio.Set(float64(e.nodesSeen) / float64(e.expectedNodes))
+			metrics <- e.coverageRatio
+		}
+	}
+	for _, w := range e.checkInWindows {
+		metrics <- w.gauge
+	}
+	e.collectCountedAggregates(metrics)
+	// The sampled nodes alone would give misleading aggregates.
+	if e.sampleFraction == 1 {
+		e.collectRowAggregates(metrics)
+	}
+	e.collectRequestedAttributes(metrics)
+}
+
+// collectCountedAggregates exports the aggregates that are counted by the
+// Chef server while sampling.
+func (e *Exporter) collectCountedAggregates(metrics chan<- prometheus.Metric) {
+	e.clientVersions.Collect(metrics)
+	metrics <- e.futureNodes
+	e.policyGroups.Collect(metrics)
+	metrics <- e.environments
+	metrics <- e.roles
+	metrics <- e.ohaiAgeHistogram()
+}
+
+// collectRowAggregates exports the aggregates computed from the rows of
+// every node, which can't be counted by the Chef server.
+func (e *Exporter) collectRowAggregates(metrics chan<- prometheus.Metric) {
+	e.attributeCoverage.Collect(metrics)
+	if e.groupBy != nil {
+		e.nodesByGroup.Collect(metrics)
+		if e.groupByAges {
+			e.groupMeanAge.Collect(metrics)
+			e.groupNewestAge.Collect(metrics)
+		}
+	}
+	if e.freshestOhaiTime > 0 {
+		e.indexLag.Set(float64(time.Now().Unix()) - e.freshestOhaiTime)
+		metrics <- e.indexLag
+	}
+	if len(e.ohaiAges) > 0 {
+		oldest, newest := e.ohaiAges[0], e.ohaiAges[0]
+		for _, age := range e.ohaiAges {
+			oldest, newest = math.Max(oldest, age), math.Min(newest, age)
+		}
+		metrics <- prometheus.MustNewConstMetric(e.oldestAgeDesc, prometheus.GaugeValue, oldest)
+		metrics <- prometheus.MustNewConstMetric(e.newestAgeDesc, prometheus.GaugeValue, newest)
+		sorted := append([]float64{}, e.ohaiAges...)
+		sort.Float64s(sorted)
+		for p, d := range e.agePercentileDescs {
+			metrics <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, percentile(sorted, p))
+		}
+	}
+}
+
+// ohaiAgePercentiles are the percentiles of the Ohai age exported as
+// chef_fleet_ohai_age_p*_seconds, for storage backends that handle the
+// histogram poorly.
+var ohaiAgePercentiles = []float64{0.5, 0.9, 0.99}
+
+// percentile returns the p-th percentile of the sorted values by the
+// nearest-rank method, so it is always the age of an actual node.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// collectRequestedAttributes exports the attribute paths of the partial
+// search, to check what an exporter is configured to fetch.
+func (e *Exporter) collectRequestedAttributes(metrics chan<- prometheus.Metric) {
+	// Several keys may request the same path, e.g. an attribute that is
+	// also an info label.
+	paths := map[string]bool{}
+	for _, path := range e.searchParams() {
+		paths[strings.Join(path.([]string), ".")] = true
+	}
+	metrics <- prometheus.MustNewConstMetric(e.requestedAttributesDesc, prometheus.GaugeValue, float64(len(paths)))
+	for path := range paths {
+		metrics <- prometheus.MustNewConstMetric(e.requestedAttributeDesc, prometheus.GaugeValue, 1, path)
+	}
+}
+
+// ohaiAgeHistogram builds a histogram of the Ohai ages observed during the
+// last scrape, so that it reflects the current state of the fleet rather
+// than accumulating across scrapes. While sampling, the buckets are those
+// counted over all nodes and the sum is estimated from the mean age of
+// the sampled nodes.
+func (e *Exporter) ohaiAgeHistogram() prometheus.Metric {
+	var sum float64
+	buckets := make(map[float64]uint64, len(e.ohaiAgeBuckets))
+	for _, b := range e.ohaiAgeBuckets {
+		buckets[b] = 0
+	}
+	for _, age := range e.ohaiAges {
+		sum += age
+		for _, b := range e.ohaiAgeBuckets {
+			if age <= b {
+				buckets[b]++
+			}
+		}
+	}
+	count := uint64(len(e.ohaiAges))
+	if e.sampleFraction < 1 {
+		if count > 0 {
+			sum = sum / float64(count) * float64(e.sampledAged)
+		}
+		count = uint64(e.sampledAged)
+		for _, b := range e.ohaiAgeBuckets {
+			buckets[b] = e.sampledBuckets[b]
+		}
+	}
+	return prometheus.MustNewConstHistogram(e.ohaiAgeDesc, count, sum, buckets)
+}
+
+func (e *Exporter) exportAttributes(metrics map[int]*prometheus.GaugeVec, value float64, labels ...string) {
+	for _, metric := range metrics {
+		metric.WithLabelValues(labels...).Set(value)
+	}
+}
+
+// newCollectorDuration returns the gauge the collectors record the duration
+// of their last collection in. It is shared, as several collectors export
+// it under different collector labels.
+func newCollectorDuration() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_collector_duration_seconds",
+		Help:      "Time the collector spent fetching and parsing data in its last completed collection.",
+	}, []string{"collector"})
+}
+
+// newStartTimeCollector returns a gauge set to the time the exporter was
+// started, for uptime panels and restart detection.
+func newStartTimeCollector(start time.Time) prometheus.Gauge {
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_start_time_seconds",
+		Help:      "Start time of the exporter since unix epoch in seconds.",
+	})
+	startTime.Set(float64(start.Unix()))
+	return startTime
+}
+
+// serverLabels returns the chef_server label of -chef.server-label, the
+// host name of the Chef server URL.
+func serverLabels(chefURL string) (prometheus.Labels, error) {
+	u, err := url.Parse(chefURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("couldn't derive -chef.server-label from -chef.url %q", chefURL)
+	}
+	return prometheus.Labels{"chef_server": u.Hostname()}, nil
+}
+
+// stringSlice is a flag.Value collecting the values of a repeatable flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	// The saved search, the startup probe and the attribute validation
+	// run before the collectors are registered, and count as uptime.
+	start := time.Now()
+	var metricsPathAliases stringSlice
+	flag.Var(&metricsPathAliases, "web.telemetry-path-alias", "Additional path under which to expose metrics. May be repeated.")
+	var checkIn stringSlice
+	flag.Var(&checkIn, "chef.check-in-window", "Export chef_nodes_checked_in_last_<window>, the number of nodes that ran Ohai within the window, e.g. 1h. May be repeated. Defaults to 1h and 24h.")
+	var chefHeaders stringSlice
+	flag.Var(&chefHeaders, "chef.header", "Extra header sent with every Chef API request, as \"Name: Value\", e.g. for API gateways. May be repeated.")
+	var chefResolve stringSlice
+	flag.Var(&chefResolve, "chef.resolve", "Connect to the given IP for a Chef server host, as host:ip, instead of resolving it. May be repeated.")
+	var (
+		listenAddress  = flag.String("web.listen-address", ":9101", "Address to listen on for web interface and telemetry, as host:port or unix:/path/to/socket.")
+		cacheTTL       = flag.Duration("web.cache-ttl", 0, "Serve the metrics of the last scrape for this long instead of querying the Chef server on every request. 0 disables the cache.")
+		noDefaultColls = flag.Bool("web.disable-default-collectors", false, "Don't export the go_* and process_* metrics of the exporter itself.")
+		maxRequests    = flag.Int("web.max-requests", 4, "Maximum number of metrics requests served at the same time. Further requests get a 503. 0 means no limit.")
+		enableTargets  = flag.Bool("web.enable-targets", false, "Serve the Chef server and organizations covered by the exporter on /targets, in the Prometheus HTTP service discovery format.")
+		externalURL    = flag.String("web.external-url", "", "URL the exporter is reachable under, e.g. when served by a reverse proxy at a subpath. Links on the landing page start with its path, or with -web.route-prefix if it has none.")
+		routePrefix    = flag.String("web.route-prefix", "", "Prefix of the paths served by the exporter. Defaults to the path of -web.external-url.")
+		metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		chefServerUrl  = flag.String("chef.url", "localhost:8080", "Chef API url.")
+		serverLabel    = flag.Bool("chef.server-label", false, "Add a chef_server label with the host name of -chef.url to the metrics of the exporter, to tell Chef servers apart in a federated Prometheus.")
+		source         = flag.String("chef.source", "server", "Where the node search rows come from: server, or file to read them from -chef.file, e.g. to test dashboards without a Chef server.")
+		sourceFile     = flag.String("chef.file", "", "JSON file with a list of node search rows, for -chef.source=file. It is read on every scrape.")
+		chefSearchUrl  = flag.String("chef.search-url", "", "Chef API url used for search requests instead of -chef.url, e.g. a search replica. Uses the same credentials.")
+		searchQuery    = flag.String("chef.search-query", "*:*", "Search query selecting the nodes to export.")
+		savedSearch    = flag.String("chef.saved-search-name", "", "Name of a saved search to use instead of -chef.search-query. It is read at startup from the query field of the item with this name in the -chef.saved-search-bag data bag.")
+		savedSearchBag = flag.String("chef.saved-search-bag", "saved_searches", "Data bag holding the saved searches.")
+		sinceSeconds   = flag.Int("chef.since-seconds", 0, "Only export nodes that ran Ohai within this many seconds. 0 exports all nodes.")
+		chefClientName = flag.String("chef.client-name", "chef_exporter", "Chef client name.")
+		chefClientKey  = flag.String("chef.client-keyfile", "client.pem", "Chef client keyfile.")
+		ohaiAgeBuckets = flag.String("chef.ohai-age-buckets", "300,900,1800,3600,7200,21600,86400,604800", "Comma separated upper bounds in seconds of the Ohai age histogram buckets.")
+		chefTLSMin     = flag.String("chef.tls-min-version", "1.2", "Minimum TLS version accepted from the Chef server (1.0, 1.1, 1.2 or 1.3).")
+		maxIdleConns   = flag.Int("chef.max-idle-conns", 10, "Maximum number of idle connections kept open to the Chef server between requests.")
+		chefTLSName    = flag.String("chef.tls-server-name", "", "Server name sent with SNI and expected in the Chef server certificate, when it differs from the -chef.url host, e.g. behind a load balancer.")
+		chefTLSCiphers = flag.String("chef.tls-cipher-suites", "", "Comma separated list of TLS cipher suites allowed for the Chef server connection. Defaults to Go's secure suites.")
+		webTLSCert     = flag.String("web.tls-cert-file", "", "Path to a TLS certificate. Enables HTTPS when set together with -web.tls-key-file.")
+		webTLSKey      = flag.String("web.tls-key-file", "", "Path to the TLS key for -web.tls-cert-file.")
+		webTLSMin      = flag.String("web.tls-min-version", "1.2", "Minimum TLS version accepted by the HTTPS server (1.0, 1.1, 1.2 or 1.3).")
+		webTLSCiphers  = flag.String("web.tls-cipher-suites", "", "Comma separated list of TLS cipher suites allowed by the HTTPS server. Defaults to Go's secure suites.")
+		attributes     = flag.String("chef.attributes", "", "Comma separated list of numeric node attributes to export, e.g. \"memory.total,cpu.total\". Prefix a path with default:, normal:, override: or automatic: to read that precedence level instead of the merged value. Partial search only sees the merged values, so a prefixed path implies -chef.partial-search=false.")
+		groupBy        = flag.String("chef.group-by", "", "Node attribute, e.g. \"kernel.machine\", whose values the nodes are counted by in chef_nodes_by_group. Accepts the same paths as -chef.attributes.")
+		groupByMax     = flag.Int("chef.group-by-max-values", 100, "Maximum number of distinct -chef.group-by values counted per scrape. Nodes with further values are left out with a warning.")
+		groupByAges    = flag.Bool("chef.group-by-ages", false, "Also export the average and smallest Ohai age of each -chef.group-by value.")
+		infoLabels     = flag.String("chef.info-labels", "", "Comma separated list of node attributes, e.g. \"chef_environment,platform\", exported as labels of chef_node_info. Accepts the same paths as -chef.attributes. At most 10.")
+		attrDefaults   = flag.String("chef.attribute-defaults", "", "Comma separated path=value defaults exported for nodes missing an attribute of -chef.attributes, e.g. \"memory.swap.total=0\". Without one such nodes have no series for the attribute. Values that are present but not numeric still count as parse failures.")
+		boolAttributes = flag.String("chef.bool-attributes", "", "Comma separated list of boolean node attributes to export as 1 (true) or 0 (false). Accepts the same paths as -chef.attributes.")
+		runDuration    = flag.String("chef.run-duration-attribute", "chef_client.run_time", "Node attribute holding the duration of the last chef-client run in seconds, exported as chef_node_last_run_duration_seconds. Empty disables it.")
+		complPassed    = flag.String("chef.compliance-passed-attribute", "", "Node attribute holding the number, or the list, of compliance controls that passed, e.g. \"audit.summary.passed\". Exported as chef_node_compliance_passed. Empty disables it.")
+		complFailed    = flag.String("chef.compliance-failed-attribute", "", "Node attribute holding the number, or the list, of compliance controls that failed. Exported as chef_node_compliance_failed. Empty disables it.")
+		legacyNames    = flag.Bool("metric.legacy-names", true, "Export chef_node_time_since_ohai_seconds, chef_exporter_scrapes_total and chef_exporter_parse_failures_total under their former names chef_node_ohai_time, chef_exporter_total_scrapes and chef_exporter_parse_failures. The former names are deprecated but stay the default, so existing dashboards and alerts keep working; set to false once they use the new names.")
+		roundSeconds   = flag.Float64("metric.round-seconds", 0, "Round the Ohai age of chef_node_time_since_ohai_seconds to a multiple of this many seconds, e.g. 1 for whole seconds or 60 for minutes. 0 disables rounding.")
+		sourceTS       = flag.Bool("metric.use-source-timestamp", false, "Timestamp chef_node_time_since_ohai_seconds with the ohai_time of the node instead of the scrape time. The age is still that at scrape time, and chef_node_status keeps the scrape time. Timestamps more than 1h old, which Prometheus would reject, are clamped to 1h ago.")
+		stateFile      = flag.String("metric.state-file", "", "File where the node metrics of the last successful scrape are saved, and served from after a restart until the next successful scrape.")
+		partialSearch  = flag.Bool("chef.partial-search", true, "Use partial search to fetch only the needed attributes. When false, whole node objects are fetched, which costs far more bandwidth and memory on large fleets.")
+		nodeIDField    = flag.String("chef.node-id-field", "name", "Node attribute used as the node label, e.g. \"fqdn\". Accepts the same paths as -chef.attributes. Nodes missing it are labelled with their name.")
+		labelPolicy    = flag.Bool("chef.label-policy", false, "Add policy_name and policy_group labels to node metrics.")
+		labelIPFamily  = flag.Bool("chef.label-ip-family", false, "Add an ip_family label (ipv4, ipv6 or unknown) derived from the ipaddress attribute to node metrics.")
+		nodeLabels     = flag.String("chef.node-labels", "", "Comma separated list of the labels of node metrics, out of node, policy_name, policy_group and ip_family. node is always included. Replaces -chef.label-policy and -chef.label-ip-family.")
+		versionMajor   = flag.Bool("chef.client-version-major", false, "Group chef_nodes_by_client_version by major chef-client version only.")
+		ageBuckets     = flag.String("chef.age-buckets", "", "Comma separated increasing Ohai ages, e.g. \"1h,6h,24h\", adding an age_bucket label such as <1h, 1h-6h, 6h-24h or >24h to chef_node_status. Nodes without ohai_time are in the unknown bucket. Empty disables the label.")
+		staleThreshold = flag.Duration("chef.stale-threshold", time.Hour, "Ohai age above which chef_node_status reports a node as stale.")
+		pageSize       = flag.Int("chef.page-size", 1000, "Number of nodes requested per search page. Failed pages are retried with half the size, up to 4 times per scrape.")
+		expectedNodes  = flag.Int("chef.expected-nodes", 0, "Expected number of nodes, e.g. from a CMDB. When set, chef_node_coverage_ratio reports the share of them returned by the search.")
+		maxSeries      = flag.Int("chef.max-series", 200000, "Maximum number of per-node series to export. Above it only aggregates are exported and chef_up is 0. 0 disables the limit.")
+		breakerFails   = flag.Int("chef.breaker-failures", 0, "Consecutive failed scrapes after which the Chef server is no longer queried for -chef.breaker-cooldown. 0 disables the circuit breaker.")
+		breakerCool    = flag.Duration("chef.breaker-cooldown", time.Minute, "How long to skip Chef server queries once the circuit breaker is open.")
+		discoverOrgs   = flag.Bool("chef.discover-orgs", false, "List the organizations on the Chef server at startup and export the nodes of each, with an org label. -chef.url may point at any organization; -chef.search-url is ignored.")
+		debugPprof     = flag.Bool("debug.pprof", false, "Serve Go runtime profiles on /debug/pprof/, for diagnosing slow or memory hungry scrapes.")
+		debugEnable    = flag.Bool("debug.enable", false, "Serve the rows returned by the last node search on /debug/last-search, for troubleshooting attribute paths.")
+		metadataFile   = flag.String("metadata.file", "", "JSON file of node names to labels kept outside Chef, e.g. {\"web01\": {\"team\": \"frontend\"}}, exported as chef_node_metadata for joins on the node label. Reloaded on SIGHUP.")
+		labelsFile     = flag.String("labels.file", "", "File of key=value lines added as labels to all metrics, e.g. region=eu-west-1. Reloaded on SIGHUP.")
+		graphiteAddr   = flag.String("graphite.address", "", "Graphite/Carbon plaintext listener, as host:port, to push the metrics to every -graphite.interval. Empty disables pushing.")
+		graphitePrefix = flag.String("graphite.prefix", "", "Prefix of the metric paths pushed to Graphite.")
+		graphiteEvery  = flag.Duration("graphite.interval", time.Minute, "How often to push the metrics to Graphite.")
+		indexes        = flag.String("chef.indexes", "", "Comma separated list of search indexes, e.g. \"node,role,environment\", whose objects are counted in chef_index_objects_total with a count-only search each. The node scrape runs either way.")
+		reportsWindow  = flag.Duration("collector.reports-window", 24*time.Hour, "How far back to look for chef-client runs in the Reporting API. Nodes without a run in the window are not exported.")
+		countOnly      = flag.Bool("chef.count-only", false, "Run a count-only node search at startup to validate the Chef settings.")
+		validateAttrs  = flag.Bool("chef.validate-attributes", false, "Run a search at startup and warn about configured attributes missing on every node.")
+		strictAttrs    = flag.Bool("chef.strict-attributes", false, "Exit if -chef.validate-attributes finds missing attributes.")
+		shardIndex     = flag.Int("chef.shard-index", 0, "Shard of the nodes exported by this exporter, from 0 to -chef.shard-total minus 1.")
+		shardTotal     = flag.Int("chef.shard-total", 1, "Number of exporters sharing the nodes. A node is exported by the shard equal to the 32-bit FNV-1a hash of its name modulo this number.")
+		strictDecode   = flag.Bool("chef.strict-decode", false, "Check the search rows for unexpected keys and types, counting them in chef_exporter_decode_anomalies_total. Rows that can't be used are dropped instead of being coerced.")
+		maxRespBytes   = flag.Int64("chef.max-response-bytes", 256<<20, "Maximum size in bytes of a decompressed Chef API response. Larger responses fail the request instead of exhausting memory. 0 disables the limit.")
+		sampleFraction = flag.Float64("chef.sample-fraction", 1, "Fraction of the nodes fetched per scrape, e.g. 0.1 for a tenth. The nodes are split into 1/fraction samples, rounded up, by a hash of their name, and each scrape fetches the next sample after listing the node names, so every node is refreshed once per 1/fraction scrapes and keeps its last values in between. chef_nodes_matching, chef_nodes_checked_in_last_*, chef_nodes_missing_ohai_time, chef_nodes_zombie_total, chef_nodes_future_ohai_total, chef_nodes_by_client_version, chef_nodes_by_policy_group, chef_environments_total, chef_roles_total and the buckets of the Ohai age histogram are counted over all nodes by the Chef server, with one search per bucket and per value seen in the samples; the histogram sum is estimated from the sampled nodes. The aggregates that need every node's attributes aren't exported while sampling: chef_fleet_oldest_ohai_age_seconds, chef_fleet_newest_ohai_age_seconds, chef_fleet_ohai_age_p*_seconds, chef_search_index_lag_seconds, chef_node_attribute_coverage and the -chef.group-by metrics.")
+		maxAge         = flag.Int("chef.max-age-seconds", 0, "Ohai age in seconds above which nodes are considered decommissioned. They are counted in chef_nodes_zombie_total but get no per-node series. 0 disables the cutoff.")
+		allowEmpty     = flag.Bool("chef.allow-empty", true, "Consider a search returning no nodes a successful scrape. When false, it sets chef_up to 0, to alert on an unexpectedly empty fleet.")
+		unknownAge     = flag.String("chef.unknown-age-value", "NaN", "Value of chef_node_time_since_ohai_seconds for nodes that never ran Ohai. NaN keeps them out of aggregations and alerts on the age; a number such as -1 makes them show on dashboards, but is included in sums and averages. chef_node_ohai_time_present tells them apart either way.")
+		onFailure      = flag.String("metric.on-failure", onFailureClear, "What to do with the per-node metrics when a scrape fails: clear drops them, retain serves the values of the last successful scrape, mark-stale does the same and also sets chef_node_stale to 1 for each node.")
+		dedup          = flag.String("chef.dedup", dedupKeepFreshest, "What to do with search rows sharing a node label: keep-freshest keeps the row with the latest ohai_time, keep-first the first row, error fails the scrape.")
+		strictUp       = flag.Bool("chef.strict-up", false, "Set chef_up to 0 when a search page fails after others succeeded. By default the nodes fetched so far are exported, chef_up is 1 and chef_scrape_partial is 1.")
+		failOnStartup  = flag.Bool("chef.fail-on-startup-error", false, "Exit if the -chef.count-only startup probe fails, instead of logging a warning.")
+		logLevel       = flag.String("log.level", "info", "Log level, debug or info. Debug logs the timing of every search page and collector.")
+		showVersion    = flag.Bool("version", false, "Print version information.")
+	)
+	collectors := newCollectorRegistry()
+	collectors.add(flag.CommandLine, "reports", "Export the start time of the last chef-client run of each node from the Chef Reporting API.",
+		func(e *Exporter) apiCollector { return NewReportsCollector(e, *reportsWindow) })
+	collectors.add(flag.CommandLine, "orphans", "Export the number of nodes without an API client and of clients without a node. Takes two extra Chef API requests.",
+		func(e *Exporter) apiCollector { return NewOrphansCollector(e) })
+	collectors.add(flag.CommandLine, "data_bags", "Export the number of data bags and of items in each. Takes a Chef API request per data bag.",
+		func(e *Exporter) apiCollector { return NewDataBagsCollector(e) })
+	collectors.addServer(flag.CommandLine, "server_status", "Export the health of the Chef server components from its /_status endpoint.",
+		func(e *Exporter) apiCollector { return NewServerStatusCollector(e) })
+	var indexNames []string
+	collectors.addEnabledBy("indexes", func() bool { return len(indexNames) > 0 },
+		func(e *Exporter) apiCollector { return NewIndexesCollector(e, indexNames) })
+	flag.Parse()
+	if *showVersion {
 		fmt.Fprintln(os.Stdout, version.Print("chef_exporter"))
 		os.Exit(0)
 	}
 
+	if err := setLogLevel(*logLevel); err != nil {
+		log.Fatal(err)
+	}
 	log.Println("Starting chef_exporter", version.Info())
 	log.Println("Build context", version.BuildContext())
-	exporter, err := NewExporter(*chefServerUrl, *chefClientName, *chefClientKey)
+	buckets, err := parseBuckets(*ohaiAgeBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chefTLSConfig, err := newTLSConfig(*chefTLSMin, *chefTLSCiphers)
+	if err != nil {
+		log.Fatal("Invalid Chef TLS settings: ", err)
+	}
+	chefTLSConfig.ServerName = *chefTLSName
+	resolve, err := parseResolve(chefResolve)
+	if err != nil {
+		log.Fatal(err)
+	}
+	headers, err := parseHeaders(chefHeaders)
+	if err != nil {
+		log.Fatal(err)
+	}
+	connStats := newConnStats(*maxIdleConns)
+	chefHTTPClient := newChefHTTPClient(chefTLSConfig, resolve, headers, connStats)
+	webTLSConfig, err := newTLSConfig(*webTLSMin, *webTLSCiphers)
+	if err != nil {
+		log.Fatal("Invalid web TLS settings: ", err)
+	}
+	attrs, err := parseAttributes(*attributes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	boolAttrs, err := parseBoolAttributes(*boolAttributes)
 	if err != nil {
 		log.Fatal(err)
 	}
-	prometheus.MustRegister(exporter)
+	attrs = append(attrs, boolAttrs...)
+	switch *dedup {
+	case dedupKeepFreshest, dedupKeepFirst, dedupError:
+	default:
+		log.Fatalf("Invalid -chef.dedup %q, expected keep-freshest, keep-first or error", *dedup)
+	}
+	unknownAgeValue, err := strconv.ParseFloat(*unknownAge, 64)
+	if err != nil {
+		log.Fatalf("Invalid -chef.unknown-age-value %q: %v", *unknownAge, err)
+	}
+	switch *onFailure {
+	case onFailureClear, onFailureRetain, onFailureMarkStale:
+	default:
+		log.Fatalf("Invalid -metric.on-failure %q, expected clear, retain or mark-stale", *onFailure)
+	}
+	if *shardTotal < 1 || *shardIndex < 0 || *shardIndex >= *shardTotal {
+		log.Fatal("-chef.shard-index must be between 0 and -chef.shard-total minus 1")
+	}
+	if *sampleFraction <= 0 || *sampleFraction > 1 {
+		log.Fatal("-chef.sample-fraction must be greater than 0 and at most 1")
+	}
+	if *sampleFraction < 1 && (*shardTotal > 1 || *source == "file") {
+		log.Fatal("-chef.sample-fraction can't be combined with -chef.shard-total or -chef.source=file")
+	}
+	if *roundSeconds < 0 {
+		log.Fatal("-metric.round-seconds must not be negative")
+	}
+	switch *source {
+	case "server":
+		*sourceFile = ""
+	case "file":
+		if *sourceFile == "" {
+			log.Fatal("-chef.source=file needs -chef.file")
+		}
+		if *savedSearch != "" || *discoverOrgs || *countOnly || *validateAttrs || collectors.anyEnabled() || *indexes != "" {
+			log.Fatal("-chef.source=file can't be combined with flags querying the Chef server")
+		}
+	default:
+		log.Fatalf("Invalid -chef.source %q, expected server or file", *source)
+	}
+	if *indexes != "" {
+		if indexNames, err = parseIndexes(*indexes); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var labelNames []string
+	if *nodeLabels != "" {
+		if *labelPolicy || *labelIPFamily {
+			log.Fatal("-chef.node-labels can't be combined with -chef.label-policy or -chef.label-ip-family")
+		}
+		if labelNames, err = parseNodeLabels(*nodeLabels); err != nil {
+			log.Fatal(err)
+		}
+	}
+	info, err := parseInfoLabels(*infoLabels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var group *nodeAttribute
+	if *groupBy != "" {
+		if group, err = parseAttribute(*groupBy); err != nil {
+			log.Fatal(err)
+		}
+		if *groupByMax < 1 {
+			log.Fatal("-chef.group-by-max-values must be at least 1")
+		}
+	}
+	if *runDuration != "" {
+		a, err := newNamedAttribute("last_run_duration_seconds", *runDuration, "Duration of the last chef-client run in seconds.")
+		if err != nil {
+			log.Fatal(err)
+		}
+		attrs = append(attrs, a)
+	}
+	for _, c := range []struct{ name, path, help string }{
+		{"compliance_passed", *complPassed, "Number of compliance controls that passed on the node."},
+		{"compliance_failed", *complFailed, "Number of compliance controls that failed on the node."},
+	} {
+		if c.path == "" {
+			continue
+		}
+		a, err := newNamedAttribute(c.name, c.path, c.help)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.count = true
+		attrs = append(attrs, a)
+	}
+	if err := setAttributeDefaults(*attrDefaults, attrs); err != nil {
+		log.Fatal(err)
+	}
+	if len(checkIn) == 0 {
+		checkIn = stringSlice{"1h", "24h"}
+	}
+	windows, err := parseCheckInWindows(checkIn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var statusBuckets []ageBucket
+	if *ageBuckets != "" {
+		if statusBuckets, err = parseAgeBuckets(*ageBuckets); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var nodeID []string
+	if *nodeIDField != "name" {
+		if nodeID, err = parseAttributePath(*nodeIDField); err != nil {
+			log.Fatal(err)
+		}
+	}
+	collectorDuration := newCollectorDuration()
+	opts := ExporterOpts{
+		ChefServerURL:      *chefServerUrl,
+		SearchURL:          *chefSearchUrl,
+		SearchQuery:        *searchQuery,
+		SinceSeconds:       *sinceSeconds,
+		ChefClientName:     *chefClientName,
+		ChefClientKey:      *chefClientKey,
+		HTTPClient:         chefHTTPClient,
+		OhaiAgeBuckets:     buckets,
+		Attributes:         attrs,
+		BreakerThreshold:   *breakerFails,
+		BreakerCooldown:    *breakerCool,
+		StateFile:          *stateFile,
+		ClientVersionMajor: *versionMajor,
+		LabelPolicy:        *labelPolicy,
+		LabelIPFamily:      *labelIPFamily,
+		NodeLabels:         labelNames,
+		FullNodes:          !*partialSearch,
+		StaleThreshold:     *staleThreshold,
+		MaxSeries:          *maxSeries,
+		NodeIDField:        nodeID,
+		PageSize:           *pageSize,
+		CheckInWindows:     windows,
+		AgeBuckets:         statusBuckets,
+		ExpectedNodes:      *expectedNodes,
+		StrictUp:           *strictUp,
+		Dedup:              *dedup,
+		OnFailure:          *onFailure,
+		UnknownAge:         &unknownAgeValue,
+		AllowEmpty:         *allowEmpty,
+		MaxAge:             time.Duration(*maxAge) * time.Second,
+		LegacyNames:        *legacyNames,
+		SampleFraction:     *sampleFraction,
+		MaxResponseBytes:   *maxRespBytes,
+		StrictDecode:       *strictDecode,
+		ShardIndex:         *shardIndex,
+		ShardTotal:         *shardTotal,
+		SourceTimestamps:   *sourceTS,
+		RoundSeconds:       *roundSeconds,
+		InfoLabels:         info,
+		GroupBy:            group,
+		SourceFile:         *sourceFile,
+		GroupByMaxValues:   *groupByMax,
+		GroupByAges:        *groupByAges,
+		DebugLastSearch:    *debugEnable,
+		CollectorDuration:  collectorDuration,
+	}
+	if *serverLabel {
+		if opts.ConstLabels, err = serverLabels(*chefServerUrl); err != nil {
+			log.Fatal(err)
+		}
+	}
+	exporter, err := NewExporter(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *savedSearch != "" {
+		query, err := exporter.savedSearch(context.Background(), *savedSearchBag, *savedSearch)
+		if err != nil {
+			log.Fatal("Couldn't read saved search: ", err)
+		}
+		log.Printf("Using saved search %s: %s", *savedSearch, query)
+		exporter.searchQuery = query
+		opts.SearchQuery = query
+	}
+	if err := validateSearchQuery(opts.SearchQuery); err != nil {
+		log.Fatalf("Invalid search query %q: %v", opts.SearchQuery, err)
+	}
+	if *countOnly {
+		if err := exporter.startupProbe(context.Background(), *failOnStartup); err != nil {
+			log.Fatal("Startup probe failed: ", err)
+		}
+	}
+	if *validateAttrs && len(attrs) > 0 {
+		missing, err := exporter.validateAttributes(context.Background())
+		if err != nil {
+			log.Print("Warning: couldn't validate attributes: ", err)
+		} else if len(missing) > 0 {
+			if *strictAttrs {
+				log.Fatal("Attributes missing on every node: ", strings.Join(missing, ", "))
+			}
+			log.Print("Warning: attributes missing on every node, check for typos: ", strings.Join(missing, ", "))
+		}
+	}
+	var exporters []*Exporter
+	if *discoverOrgs {
+		orgs, err := exporter.organizations(context.Background())
+		if err != nil {
+			log.Fatal("Couldn't list organizations: ", err)
+		}
+		exporters, err = orgExporters(opts, orgs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		exporters = []*Exporter{exporter}
+	}
+	if *noDefaultColls {
+		disableDefaultCollectors()
+	}
+	for _, e := range exporters {
+		prometheus.MustRegister(e)
+	}
+	if err := collectors.register(prometheus.DefaultRegisterer, exporter, exporters); err != nil {
+		log.Fatal(err)
+	}
+	prometheus.MustRegister(collectorDuration)
+	prometheus.MustRegister(connStats)
 	prometheus.MustRegister(version.NewCollector("chef_exporter"))
+	prometheus.MustRegister(newStartTimeCollector(start))
+
+	var labels *fileLabels
+	if *labelsFile != "" {
+		labels, err = newFileLabels(*labelsFile)
+		if err != nil {
+			log.Fatal("Couldn't read labels file: ", err)
+		}
+		prometheus.DefaultGatherer = labels.gatherer(prometheus.DefaultGatherer)
+	}
+	var metadata *nodeMetadata
+	if *metadataFile != "" {
+		metadata, err = newNodeMetadata(*metadataFile)
+		if err != nil {
+			log.Fatal("Couldn't read metadata file: ", err)
+		}
+		prometheus.MustRegister(metadata)
+	}
+	if labels != nil || metadata != nil {
+		reloader := newConfigReloader()
+		if labels != nil {
+			reloader.add("labels", labels.load)
+		}
+		if metadata != nil {
+			reloader.add("metadata", metadata.load)
+		}
+		prometheus.MustRegister(reloader)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				reloader.reload()
+			}
+		}()
+	}
+
+	cache := newCachedGatherer(prometheus.DefaultGatherer, *cacheTTL)
+	if *graphiteAddr != "" {
+		// Pushes reuse the metrics of a scrape within the interval, so
+		// pushing doesn't add searches while Prometheus scrapes too.
+		maxAge := *graphiteEvery
+		if *cacheTTL > maxAge {
+			maxAge = *cacheTTL
+		}
+		p := &graphitePusher{address: *graphiteAddr, prefix: *graphitePrefix, gatherer: cache.gatherer(maxAge)}
+		go p.run(*graphiteEvery)
+	}
 
 	log.Println("Listening on", *listenAddress)
-	http.Handle(*metricsPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Chef Exporter</title></head>
-             <body>
-             <h1>Chef Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	metricsHandler := limitRequests(nodeHandler(exporters, labels, orgHandler(exporters, labels, prometheus.InstrumentHandler("prometheus", cachedHandler(cache)))), *maxRequests)
+	external, externalPath, prefix, err := webPaths(*externalURL, *routePrefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// net/http/pprof registers itself on the default mux when imported,
+	// so a mux of our own keeps it off unless -debug.pprof is set.
+	mux := metricsMux(metricsHandler, *metricsPath, metricsPathAliases)
+	mux.Handle("/metrics.json", jsonHandler(exporters))
+	if *enableTargets {
+		mux.Handle("/targets", targetsHandler(exporters, external, externalPath+*metricsPath))
+	}
+	if *debugEnable {
+		mux.Handle("/debug/last-search", lastSearchHandler(exporters))
+	}
+	if *debugPprof {
+		handlePprof(mux)
+	}
+	mux.Handle("/", landingPage(externalPath+*metricsPath))
+	listener, err := listen(*listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: withRoutePrefix(prefix, mux), TLSConfig: webTLSConfig}
+	// Closing the server closes the listener, which removes a Unix socket.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-stop
+		log.Printf("Received %s, shutting down", s)
+		server.Close()
+	}()
+	if *webTLSCert != "" && *webTLSKey != "" {
+		err = server.ServeTLS(listener, *webTLSCert, *webTLSKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
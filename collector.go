@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiCollector is a collector of Chef API data, such as the node search or
+// one of the optional collectors. It only implements the requests and
+// metrics of its own; getting the Chef client and timing are left to
+// runCollector.
+type apiCollector interface {
+	// Name is the name of the collector in the collector label of
+	// chef_exporter_collector_duration_seconds, followed by the
+	// organization with -chef.discover-orgs. The flag of an optional
+	// collector is -collector.<name>, with dashes instead of underscores.
+	Name() string
+	Describe(ch chan<- *prometheus.Desc)
+	// Collect sends the metrics to ch using client. On error, the
+	// metrics already sent are kept.
+	Collect(ctx context.Context, client *chef.Client, ch chan<- prometheus.Metric) error
+}
+
+// clientUser is implemented by the collectors that don't always use the
+// Chef client. They get a nil client when usesClient returns false. The
+// other collectors always get one.
+type clientUser interface {
+	usesClient() bool
+}
+
+// runCollector runs c with the Chef client of e and records how long it
+// took.
+func runCollector(ctx context.Context, e *Exporter, c apiCollector, ch chan<- prometheus.Metric) error {
+	name := e.collectorLabel(c.Name())
+	start := time.Now()
+	defer func() {
+		if e.collectorDuration != nil {
+			e.collectorDuration.WithLabelValues(name).Set(time.Since(start).Seconds())
+		}
+		debugf("Collector %s took %s", name, time.Since(start))
+	}()
+
+	var client *chef.Client
+	if u, ok := c.(clientUser); !ok || u.usesClient() {
+		var err error
+		if client, err = e.getClient(); err != nil {
+			return err
+		}
+	}
+	return c.Collect(ctx, client, ch)
+}
+
+// collectorLabel returns the collector label of the collector name for the
+// organization of e.
+func (e *Exporter) collectorLabel(name string) string {
+	if e.org != "" {
+		return name + "_" + e.org
+	}
+	return name
+}
+
+// chefCollector is the prometheus.Collector running an optional
+// apiCollector with the Chef client of an exporter.
+type chefCollector struct {
+	exporter  *Exporter
+	collector apiCollector
+}
+
+// Describe implements prometheus.Collector.
+func (c *chefCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *chefCollector) Collect(ch chan<- prometheus.Metric) {
+	// prometheus.Collector has no context of its own.
+	if err := runCollector(context.Background(), c.exporter, c.collector, ch); err != nil {
+		log.Printf("Collector %s failed: %v", c.exporter.collectorLabel(c.collector.Name()), err)
+	}
+}
+
+// registeredCollector is an optional collector of a collectorRegistry.
+type registeredCollector struct {
+	name    string
+	enabled func() bool
+	// server is set for the collectors of the Chef server as a whole,
+	// which run once rather than per organization.
+	server  bool
+	factory func(e *Exporter) apiCollector
+}
+
+// collectorRegistry holds the optional collectors, each enabled with a
+// -collector.<name> flag or a flag of its own. Collectors are added before
+// the flags are parsed.
+type collectorRegistry struct {
+	collectors []registeredCollector
+}
+
+func newCollectorRegistry() *collectorRegistry {
+	return &collectorRegistry{}
+}
+
+// add adds a collector built by factory for each organization and defines
+// its flag on fs.
+func (r *collectorRegistry) add(fs *flag.FlagSet, name string, help string, factory func(e *Exporter) apiCollector) {
+	r.addFlag(fs, name, help, false, factory)
+}
+
+// addServer is add for a collector of the Chef server as a whole, which
+// runs once with the exporter of the base organization.
+func (r *collectorRegistry) addServer(fs *flag.FlagSet, name string, help string, factory func(e *Exporter) apiCollector) {
+	r.addFlag(fs, name, help, true, factory)
+}
+
+func (r *collectorRegistry) addFlag(fs *flag.FlagSet, name string, help string, server bool, factory func(e *Exporter) apiCollector) {
+	enabled := fs.Bool("collector."+strings.Replace(name, "_", "-", -1), false, help)
+	r.collectors = append(r.collectors, registeredCollector{name: name, enabled: func() bool { return *enabled }, server: server, factory: factory})
+}
+
+// addEnabledBy adds a collector built by factory for each organization,
+// enabled by another flag than -collector.<name>, such as -chef.indexes.
+// enabled is only called once the flags are parsed.
+func (r *collectorRegistry) addEnabledBy(name string, enabled func() bool, factory func(e *Exporter) apiCollector) {
+	r.collectors = append(r.collectors, registeredCollector{name: name, enabled: enabled, factory: factory})
+}
+
+// anyEnabled reports whether any of the collectors is enabled.
+func (r *collectorRegistry) anyEnabled() bool {
+	for _, c := range r.collectors {
+		if c.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// register registers the enabled collectors with reg: the Chef server
+// collectors with the Chef client of base, the others with the client of
+// each of exporters, which carry the org label with -chef.discover-orgs.
+func (r *collectorRegistry) register(reg prometheus.Registerer, base *Exporter, exporters []*Exporter) error {
+	for _, c := range r.collectors {
+		if !c.enabled() {
+			continue
+		}
+		targets := exporters
+		if c.server {
+			targets = []*Exporter{base}
+		}
+		for _, e := range targets {
+			if err := reg.Register(&chefCollector{exporter: e, collector: c.factory(e)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
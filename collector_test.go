@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectorDuration(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100))
+	stub.mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	duration := newCollectorDuration()
+	e := newTestExporter(t, stub.URL, ExporterOpts{CollectorDuration: duration})
+	gather(t, e, &chefCollector{exporter: e, collector: NewDataBagsCollector(e)})
+	// Gathered afterwards, as a registry collects concurrently.
+	mfs := gather(t, duration)
+
+	for _, name := range []string{"node", "data_bags"} {
+		m := findMetric(mfs, "chef_exporter_collector_duration_seconds", map[string]string{"collector": name})
+		if m == nil || m.Gauge.GetValue() <= 0 {
+			t.Errorf("collector %s recorded no duration: %v", name, m)
+		}
+	}
+}
+
+// registered records the collectors registered with it.
+type registered struct {
+	collectors []*chefCollector
+}
+
+func (r *registered) Register(c prometheus.Collector) error {
+	r.collectors = append(r.collectors, c.(*chefCollector))
+	return nil
+}
+
+func (r *registered) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		r.Register(c)
+	}
+}
+
+func (r *registered) Unregister(c prometheus.Collector) bool {
+	return false
+}
+
+func TestCollectorRegistry(t *testing.T) {
+	fs := flag.NewFlagSet("chef_exporter", flag.ContinueOnError)
+	indexes := false
+	r := newCollectorRegistry()
+	r.add(fs, "data_bags", "", func(e *Exporter) apiCollector { return NewDataBagsCollector(e) })
+	r.add(fs, "orphans", "", func(e *Exporter) apiCollector { return NewOrphansCollector(e) })
+	r.addServer(fs, "server_status", "", func(e *Exporter) apiCollector { return NewServerStatusCollector(e) })
+	r.addEnabledBy("indexes", func() bool { return indexes }, func(e *Exporter) apiCollector { return NewIndexesCollector(e, []string{"client"}) })
+	if r.anyEnabled() {
+		t.Error("collectors enabled without their flags")
+	}
+	if err := fs.Parse([]string{"-collector.data-bags", "-collector.server-status"}); err != nil {
+		t.Fatal(err)
+	}
+	indexes = true
+	if !r.anyEnabled() {
+		t.Error("no collector enabled")
+	}
+
+	stub := newChefStub(t)
+	base := newTestExporter(t, stub.URL, ExporterOpts{})
+	exporters, err := orgExporters(ExporterOpts{ChefServerURL: stub.URL + "/", ChefClientName: "test", ChefClientKey: testKeyFile(t)},
+		map[string]string{"acme": stub.URL + "/organizations/acme", "beta": stub.URL + "/organizations/beta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reg registered
+	if err := r.register(&reg, base, exporters); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for _, c := range reg.collectors {
+		if c.collector.Name() == "server_status" && c.exporter != base {
+			t.Error("server_status registered with an organization's exporter")
+		}
+		got[c.exporter.collectorLabel(c.collector.Name())]++
+	}
+	want := map[string]int{"data_bags_acme": 1, "data_bags_beta": 1, "indexes_acme": 1, "indexes_beta": 1, "server_status": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registered %v, want %v", got, want)
+	}
+}
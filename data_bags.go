@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/go-chef/chef"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DataBagsCollector reports the data bags of the Chef organization and the
+// number of items in each. Listing them takes a request per data bag.
+type DataBagsCollector struct {
+	exporter *Exporter
+	bags     *prometheus.Desc
+	items    *prometheus.Desc
+}
+
+// NewDataBagsCollector returns a collector using the Chef client of e.
+func NewDataBagsCollector(e *Exporter) *DataBagsCollector {
+	return &DataBagsCollector{
+		exporter: e,
+		bags: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "data_bags_total"),
+			"Number of data bags in the organization.",
+			nil, e.constLabels,
+		),
+		items: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "data_bag_items_total"),
+			"Number of items in the data bag.",
+			[]string{"data_bag"}, e.constLabels,
+		),
+	}
+}
+
+// Name implements apiCollector.
+func (c *DataBagsCollector) Name() string {
+	return "data_bags"
+}
+
+// Describe implements apiCollector.
+func (c *DataBagsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bags
+	ch <- c.items
+}
+
+// Collect implements apiCollector. Nothing is exported when the client
+// isn't allowed to list the data bags; data bags it can't read are left
+// out.
+func (c *DataBagsCollector) Collect(ctx context.Context, client *chef.Client, ch chan<- prometheus.Metric) error {
+	e := c.exporter
+	var bags map[string]string
+	if err := e.do(ctx, client, "GET", "data", nil, &bags); err != nil {
+		return fmt.Errorf("couldn't list data bags: %w", err)
+	}
+	ch <- prometheus.MustNewConstMetric(c.bags, prometheus.GaugeValue, float64(len(bags)))
+	for name := range bags {
+		var items map[string]string
+		if err := e.do(ctx, client, "GET", "data/"+url.PathEscape(name), nil, &items); err != nil {
+			log.Printf("Couldn't list the items of data bag %s: %v", name, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(len(items)), name)
+	}
+	return nil
+}
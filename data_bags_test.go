@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDataBagsCollector(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"users":"` + stub.URL + `/data/users","secrets":"` + stub.URL + `/data/secrets"}`))
+	})
+	stub.mux.HandleFunc("/data/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"alice":"` + stub.URL + `/data/users/alice","bob":"` + stub.URL + `/data/users/bob"}`))
+	})
+	stub.mux.HandleFunc("/data/secrets", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":["forbidden"]}`, http.StatusForbidden)
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewDataBagsCollector(e)})
+
+	if v := gaugeValue(t, mfs, "chef_data_bags_total", nil); v != 2 {
+		t.Errorf("got %v data bags, want 2", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_data_bag_items_total", map[string]string{"data_bag": "users"}); v != 2 {
+		t.Errorf("got %v items in users, want 2", v)
+	}
+	if m := findMetric(mfs, "chef_data_bag_items_total", map[string]string{"data_bag": "secrets"}); m != nil {
+		t.Errorf("got %v for a data bag that can't be read", m)
+	}
+}
+
+func TestDataBagsCollectorForbidden(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":["forbidden"]}`, http.StatusForbidden)
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	if mfs := gather(t, &chefCollector{exporter: e, collector: NewDataBagsCollector(e)}); len(mfs) != 0 {
+		t.Errorf("got %d metric families without permission to list data bags, want none", len(mfs))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+)
+
+// Kinds of anomalies found by -chef.strict-decode.
+const (
+	anomalyRow          = "row_shape"
+	anomalyUnknownField = "unknown_field"
+	anomalyFieldType    = "field_type"
+)
+
+// stringFields are the partial search keys requested by the exporter that
+// must hold strings, when present.
+var stringFields = []string{"name", "chef_version", "policy_name", "policy_group", "chef_environment", "ipaddress", "node_id"}
+
+// checkRows checks the search rows against what the exporter requested, for
+// -chef.strict-decode. Rows that aren't {"url": ..., "data": {...}} or whose
+// exporter-defined fields have unexpected types are dropped; unexpected
+// keys are only counted. Attribute values of the wrong type are counted as
+// parse failures as usual.
+func (e *Exporter) checkRows(rows []interface{}) []interface{} {
+	params := e.searchParams()
+	checked := rows[:0:0]
+	for i, v := range rows {
+		row, ok := v.(map[string]interface{})
+		data, dataOK := row["data"].(map[string]interface{})
+		if !ok || !dataOK {
+			e.decodeAnomaly(anomalyRow, "row %d isn't an object with a data object", i)
+			continue
+		}
+		for key := range row {
+			if key != "url" && key != "data" {
+				e.decodeAnomaly(anomalyUnknownField, "row %d has the unexpected key %q", i, key)
+			}
+		}
+		for key := range data {
+			if _, ok := params[key]; !ok {
+				e.decodeAnomaly(anomalyUnknownField, "row %d has the unrequested attribute %q", i, key)
+			}
+		}
+		if name, ok := data["name"].(string); !ok || name == "" {
+			e.decodeAnomaly(anomalyFieldType, "row %d has no name", i)
+			continue
+		}
+		if !checkFieldTypes(data) {
+			e.decodeAnomaly(anomalyFieldType, "node %s has attributes of unexpected types", data["name"])
+			continue
+		}
+		checked = append(checked, v)
+	}
+	return checked
+}
+
+// dropMalformedRows drops the rows the exporter can't use at all without
+// -chef.strict-decode: rows that aren't an object with a data object, and
+// nodes without a name. They are counted like with -chef.strict-decode.
+func (e *Exporter) dropMalformedRows(rows []interface{}) []interface{} {
+	kept := rows[:0:0]
+	for i, v := range rows {
+		data := rowData(v)
+		if data == nil {
+			e.decodeAnomaly(anomalyRow, "row %d isn't an object with a data object", i)
+			continue
+		}
+		if name, ok := data["name"].(string); !ok || name == "" {
+			e.decodeAnomaly(anomalyFieldType, "row %d has no name", i)
+			continue
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
+
+// checkFieldTypes reports whether the exporter-defined fields of a row have
+// the expected types.
+func checkFieldTypes(data map[string]interface{}) bool {
+	for _, key := range stringFields {
+		if _, ok := data[key].(string); data[key] != nil && !ok {
+			return false
+		}
+	}
+	if _, ok := data["ohai_time"].(float64); data["ohai_time"] != nil && !ok {
+		return false
+	}
+	if _, ok := data["roles"].([]interface{}); data["roles"] != nil && !ok {
+		return false
+	}
+	return true
+}
+
+func (e *Exporter) decodeAnomaly(kind string, format string, args ...interface{}) {
+	e.decodeAnomalies.WithLabelValues(kind).Inc()
+	log.Printf("WARNING: unexpected search response: "+format, args...)
+}
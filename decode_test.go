@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStrictDecode(t *testing.T) {
+	stub := newChefStub(t)
+	now := time.Now().Unix()
+	stub.mux.HandleFunc("/organizations/drift/search/node", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"total": 5, "start": 0, "rows": [
+			{"url": "http://chef/nodes/web01", "data": {"name": "web01", "ohai_time": %d}},
+			{"url": "http://chef/nodes/web02", "data": {"name": "web02", "ohai_time": "yesterday"}},
+			{"url": "http://chef/nodes/web03", "data": {"name": "web03", "ohai_time": %d, "extra": 1}},
+			{"url": "http://chef/nodes/x", "data": {"ohai_time": %d}},
+			"oops"
+		]}`, now, now, now)
+	})
+	for _, c := range []struct {
+		strict    bool
+		anomalies map[string]float64
+		exported  map[string]bool
+	}{
+		{false,
+			map[string]float64{anomalyRow: 1, anomalyFieldType: 1, anomalyUnknownField: 0},
+			map[string]bool{"web01": true, "web02": true, "web03": true}},
+		{true,
+			map[string]float64{anomalyRow: 1, anomalyFieldType: 2, anomalyUnknownField: 1},
+			map[string]bool{"web01": true, "web02": false, "web03": true}},
+	} {
+		e := newTestExporter(t, stub.URL+"/organizations/drift", ExporterOpts{StrictDecode: c.strict})
+		mfs := gather(t, e)
+		for kind, want := range c.anomalies {
+			v := 0.0
+			if m := findMetric(mfs, "chef_exporter_decode_anomalies_total", map[string]string{"kind": kind}); m != nil {
+				v = m.Counter.GetValue()
+			}
+			if v != want {
+				t.Errorf("strict=%t: got %v %s anomalies, want %v", c.strict, v, kind, want)
+			}
+		}
+		for node, want := range c.exported {
+			if got := findMetric(mfs, "chef_node_ohai_time_present", map[string]string{"node": node}) != nil; got != want {
+				t.Errorf("strict=%t: exported %s: %t, want %t", c.strict, node, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverFeatures are the version and API versions the Chef server
+// advertises in the X-Ops-API-Info and X-Ops-Server-API-Version headers of
+// its responses:
+//
+//	X-Ops-API-Info: flavor=cs;version=12.19.31;oc_erchef=12.19.31
+//	X-Ops-Server-API-Version: {"min_version":"0","max_version":"1",...}
+//
+// They are taken from the first response carrying them. Servers that send
+// neither, such as goiardi, are assumed to support everything.
+type serverFeatures struct {
+	mutex    sync.Mutex
+	detected bool
+	flavor   string
+	version  string
+	minAPI   string
+	maxAPI   string
+	desc     *prometheus.Desc
+}
+
+func newServerFeatures(constLabels prometheus.Labels) *serverFeatures {
+	return &serverFeatures{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "server", "features"),
+			"Always 1. The labels carry the version and API versions advertised by the Chef server, and whether it supports Policyfiles.",
+			[]string{"flavor", "version", "min_api_version", "max_api_version", "policyfiles"}, constLabels,
+		),
+	}
+}
+
+// detect records the features advertised in the headers of a response,
+// unless they are already known.
+func (f *serverFeatures) detect(h http.Header) {
+	info, apiVersion := h.Get("X-Ops-API-Info"), h.Get("X-Ops-Server-API-Version")
+	if info == "" && apiVersion == "" {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.detected {
+		return
+	}
+	f.detected = true
+	for _, field := range strings.Split(info, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "flavor":
+			f.flavor = kv[1]
+		case "version":
+			f.version = kv[1]
+		}
+	}
+	// Depending on the server version, the API versions are strings or
+	// numbers.
+	var versions map[string]interface{}
+	if err := json.Unmarshal([]byte(apiVersion), &versions); err == nil {
+		f.minAPI, f.maxAPI = apiVersionString(versions["min_version"]), apiVersionString(versions["max_version"])
+	}
+	debugf("Chef server advertises flavor=%s version=%s api_versions=%s-%s", f.flavor, f.version, f.minAPI, f.maxAPI)
+}
+
+func apiVersionString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// policyfiles reports whether the server supports Policyfiles, which came
+// with Chef Server 12.1. Older servers have no policy_name and policy_group
+// on their nodes.
+func (f *serverFeatures) policyfiles() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.policyfilesLocked()
+}
+
+func (f *serverFeatures) policyfilesLocked() bool {
+	if f.version == "" {
+		return true
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(f.version, "%d.%d", &major, &minor); err != nil {
+		return true
+	}
+	return major > 12 || major == 12 && minor >= 1
+}
+
+// Describe implements prometheus.Collector.
+func (f *serverFeatures) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.desc
+}
+
+// Collect implements prometheus.Collector. Nothing is exported until the
+// server advertised its features.
+func (f *serverFeatures) Collect(ch chan<- prometheus.Metric) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.detected {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(f.desc, prometheus.GaugeValue, 1,
+		f.flavor, f.version, f.minAPI, f.maxAPI, strconv.FormatBool(f.policyfilesLocked()))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerFeatures(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100))
+	advertise := func(org string, info string) {
+		stub.mux.HandleFunc("/organizations/"+org+"/search/node", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Ops-API-Info", info)
+			w.Header().Set("X-Ops-Server-API-Version", `{"min_version":"0","max_version":"1","request_version":"-1","response_version":"-1"}`)
+			stub.search(w, r)
+		})
+	}
+	advertise("old", "flavor=osc;version=11.1.7;erchef=1.4.6")
+	advertise("new", "flavor=cs;version=12.19.31;oc_erchef=12.19.31")
+	lastBody := func() string {
+		stub.mutex.Lock()
+		defer stub.mutex.Unlock()
+		return stub.bodies[len(stub.bodies)-1]
+	}
+
+	for _, c := range []struct {
+		org, version, policyfiles string
+	}{
+		{"old", "11.1.7", "false"},
+		{"new", "12.19.31", "true"},
+	} {
+		e := newTestExporter(t, stub.URL+"/organizations/"+c.org, ExporterOpts{})
+		gather(t, e)
+		// The features are known from the second scrape on.
+		mfs := gather(t, e)
+		labels := map[string]string{"version": c.version, "min_api_version": "0", "max_api_version": "1", "policyfiles": c.policyfiles}
+		if findMetric(mfs, "chef_server_features", labels) == nil {
+			t.Errorf("%s: no chef_server_features%v", c.org, labels)
+		}
+		if requested := strings.Contains(lastBody(), "policy_name"); requested != (c.policyfiles == "true") {
+			t.Errorf("%s: requested policy_name from Chef Server %s: %t", c.org, c.version, requested)
+		}
+	}
+
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	mfs := gather(t, e)
+	if m := findMetric(mfs, "chef_server_features", nil); m != nil {
+		t.Errorf("got %v from a server advertising nothing", m)
+	}
+	if !strings.Contains(lastBody(), "policy_name") {
+		t.Error("policy_name not requested from a server advertising nothing")
+	}
+}
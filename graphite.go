@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var invalidGraphiteChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// graphitePusher periodically sends the exporter's gauges and counters to
+// a Graphite/Carbon plaintext listener, for monitoring stacks that don't
+// scrape Prometheus endpoints.
+type graphitePusher struct {
+	address  string
+	prefix   string
+	gatherer prometheus.Gatherer
+}
+
+// run pushes every interval. Failed pushes are logged and retried on the
+// next tick.
+func (p *graphitePusher) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := p.push(now); err != nil {
+			log.Print("Graphite push failed: ", err)
+		}
+	}
+}
+
+func (p *graphitePusher) push(now time.Time) error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", p.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(now.Add(time.Minute))
+	w := bufio.NewWriter(conn)
+	if err := writeGraphite(w, p.prefix, mfs, now); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeGraphite writes the gauges and counters of the exporter in the
+// Graphite plaintext format, as <prefix>.<name>.<label>.<value>... lines.
+// Other metric types, NaN values and empty labels are left out.
+func writeGraphite(w io.Writer, prefix string, mfs []*dto.MetricFamily, now time.Time) error {
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), namespace+"_") {
+			continue
+		}
+		for _, m := range mf.Metric {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(value) {
+				continue
+			}
+			path := mf.GetName()
+			if prefix != "" {
+				path = prefix + "." + path
+			}
+			for _, l := range m.Label {
+				if l.GetValue() == "" {
+					continue
+				}
+				path += "." + l.GetName() + "." + invalidGraphiteChars.ReplaceAllString(l.GetValue(), "_")
+			}
+			if _, err := fmt.Fprintf(w, "%s %g %d\n", path, value, now.Unix()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
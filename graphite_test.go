@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var graphiteLine = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+ \S+ \d+$`)
+
+func TestGraphitePush(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	stub := newChefStub(t, node("web01.example.com", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	cache := newCachedGatherer(registry, 0)
+	p := &graphitePusher{address: listener.Addr().String(), prefix: "chef", gatherer: cache.gatherer(time.Hour)}
+	now := time.Now()
+	if err := p.push(now); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(<-received, "\n"), "\n")
+	found := map[string]bool{}
+	for _, line := range lines {
+		if !graphiteLine.MatchString(line) {
+			t.Errorf("malformed line %q", line)
+		}
+		if !strings.HasSuffix(line, " "+strconv.FormatInt(now.Unix(), 10)) {
+			t.Errorf("line %q doesn't have the push time", line)
+		}
+		found[strings.Fields(line)[0]] = true
+	}
+	for _, path := range []string{"chef.chef_up", "chef.chef_node_time_since_ohai_seconds.node.web01_example_com"} {
+		if !found[path] {
+			t.Errorf("no line for %s in %q", path, lines)
+		}
+	}
+
+	// Pushes within the interval reuse the metrics of the last one.
+	if _, err := p.gatherer.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.paths()); n != 1 {
+		t.Errorf("made %d searches for two pushes, want 1", n)
+	}
+
+	// A failed push returns an error rather than crashing.
+	listener.Close()
+	if err := p.push(now); err == nil {
+		t.Error("push to a closed listener succeeded")
+	}
+}
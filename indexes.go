@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-chef/chef"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IndexesCollector reports the number of objects in search indexes, such
+// as node, role, environment, client or a data bag, with a count-only
+// search per index.
+type IndexesCollector struct {
+	exporter *Exporter
+	indexes  []string
+	objects  *prometheus.Desc
+}
+
+// NewIndexesCollector returns a collector counting the objects of the given
+// indexes with the Chef client of e.
+func NewIndexesCollector(e *Exporter, indexes []string) *IndexesCollector {
+	return &IndexesCollector{
+		exporter: e,
+		indexes:  indexes,
+		objects: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "index", "objects_total"),
+			"Number of objects in the search index.",
+			[]string{"index"}, e.constLabels,
+		),
+	}
+}
+
+// parseIndexes parses a comma separated list of search indexes as given to
+// -chef.indexes.
+func parseIndexes(s string) ([]string, error) {
+	var indexes []string
+	seen := map[string]bool{}
+	for _, index := range strings.Split(s, ",") {
+		index = strings.TrimSpace(index)
+		if index == "" || strings.ContainsAny(index, "/?#") {
+			return nil, fmt.Errorf("invalid search index %q", index)
+		}
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// Name implements apiCollector.
+func (c *IndexesCollector) Name() string {
+	return "indexes"
+}
+
+// Describe implements apiCollector.
+func (c *IndexesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.objects
+}
+
+// Collect implements apiCollector. Indexes whose search fails are left
+// out; it only fails if all of them do.
+func (c *IndexesCollector) Collect(ctx context.Context, client *chef.Client, ch chan<- prometheus.Metric) error {
+	var lastErr error
+	counted := 0
+	for _, index := range c.indexes {
+		query := chef.SearchQuery{Index: index, Query: "*:*", SortBy: "X_CHEF_id_CHEF_X asc", Rows: 0}
+		var res chef.SearchResult
+		if err := c.exporter.do(ctx, client, "GET", "search/"+query.String(), nil, &res); err != nil {
+			log.Printf("Couldn't count the objects of index %s: %v", index, err)
+			lastErr = err
+			continue
+		}
+		counted++
+		ch <- prometheus.MustNewConstMetric(c.objects, prometheus.GaugeValue, float64(res.Total), index)
+	}
+	if counted == 0 && lastErr != nil {
+		return fmt.Errorf("couldn't count the objects of any index: %w", lastErr)
+	}
+	return nil
+}
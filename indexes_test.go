@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestIndexesCollector(t *testing.T) {
+	indexes, err := parseIndexes("node, environment,role,client,node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"node", "environment", "role", "client"}; !reflect.DeepEqual(indexes, want) {
+		t.Errorf("got indexes %v, want %v", indexes, want)
+	}
+	if _, err := parseIndexes("node,../nodes"); err == nil {
+		t.Error("index with a path accepted")
+	}
+
+	stub := newChefStub(t, node("web01", 100), node("web02", 100), node("db01", 100))
+	stub.mux.HandleFunc("/search/environment", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total": 2, "start": 0, "rows": []}`))
+	})
+	stub.mux.HandleFunc("/search/role", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total": 5, "start": 0, "rows": []}`))
+	})
+	stub.mux.HandleFunc("/search/client", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":["forbidden"]}`, http.StatusForbidden)
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewIndexesCollector(e, indexes)})
+
+	for index, want := range map[string]float64{"node": 3, "environment": 2, "role": 5} {
+		if v := gaugeValue(t, mfs, "chef_index_objects_total", map[string]string{"index": index}); v != want {
+			t.Errorf("got %v objects in index %s, want %v", v, index, want)
+		}
+	}
+	if m := findMetric(mfs, "chef_index_objects_total", map[string]string{"index": "client"}); m != nil {
+		t.Errorf("got %v for an index that can't be searched", m)
+	}
+}
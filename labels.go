@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var validLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// fileLabels holds labels read from a key=value file and added to every
+// exported metric. The file can be reloaded while the exporter runs.
+type fileLabels struct {
+	path   string
+	mutex  sync.RWMutex
+	labels []*dto.LabelPair
+}
+
+func newFileLabels(path string) (*fileLabels, error) {
+	l := &fileLabels{path: path}
+	return l, l.load()
+}
+
+// load reads the labels file. On error the current labels are kept.
+func (l *fileLabels) load() error {
+	labels, err := readLabels(l.path)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.labels = labels
+	l.mutex.Unlock()
+	return nil
+}
+
+// readLabels parses a file of key=value lines. Blank lines and lines
+// starting with # are ignored.
+func readLabels(path string) ([]*dto.LabelPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	var labels []*dto.LabelPair
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key=value", path, n)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if !validLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%s:%d: invalid label name %q", path, n, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s:%d: duplicate label %q", path, n, name)
+		}
+		seen[name] = true
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	return labels, scanner.Err()
+}
+
+// gatherer returns a Gatherer adding the labels to the metrics of g. A
+// metric that already has a label of the same name keeps its own value.
+// A nil fileLabels returns g unchanged.
+func (l *fileLabels) gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	if l == nil {
+		return g
+	}
+	return labelsGatherer{labels: l, next: g}
+}
+
+type labelsGatherer struct {
+	labels *fileLabels
+	next   prometheus.Gatherer
+}
+
+// Gather implements prometheus.Gatherer.
+func (g labelsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.next.Gather()
+	g.labels.mutex.RLock()
+	defer g.labels.mutex.RUnlock()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.Label = addLabels(m.Label, g.labels.labels)
+		}
+	}
+	return mfs, err
+}
+
+func addLabels(labels, extra []*dto.LabelPair) []*dto.LabelPair {
+	have := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		have[l.GetName()] = true
+	}
+	for _, l := range extra {
+		if !have[l.GetName()] {
+			labels = append(labels, l)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
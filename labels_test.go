@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFileLabels(t *testing.T) {
+	path := writeFile(t, "labels", "# managed by config management\nregion = eu-west\n\ndatacenter=dc1\n")
+	labels, err := newFileLabels(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t, node("web01", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	g := labels.gatherer(registry)
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"region": "eu-west", "datacenter": "dc1"}
+	for _, name := range []string{"chef_up", "chef_node_time_since_ohai_seconds"} {
+		if findMetric(mfs, name, want) == nil {
+			t.Errorf("%s doesn't have the labels of the file", name)
+		}
+	}
+
+	// A reload with an invalid label name keeps the previous labels.
+	if err := ioutil.WriteFile(path, []byte("region=us-east\n0zone=a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := labels.load(); err == nil {
+		t.Error("invalid label name accepted")
+	}
+	if mfs, _ = g.Gather(); findMetric(mfs, "chef_up", want) == nil {
+		t.Error("failed reload dropped the previous labels")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("region=us-east\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := labels.load(); err != nil {
+		t.Fatal(err)
+	}
+	if mfs, _ = g.Gather(); findMetric(mfs, "chef_up", map[string]string{"region": "us-east"}) == nil {
+		t.Error("reloaded labels aren't applied")
+	}
+}
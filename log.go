@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// debugLogging enables the debug messages, set with -log.level=debug.
+var debugLogging bool
+
+// setLogLevel sets the level of the log messages, debug or info.
+func setLogLevel(level string) error {
+	switch level {
+	case "debug":
+		debugLogging = true
+	case "info":
+		debugLogging = false
+	default:
+		return fmt.Errorf("invalid log level %q, expected debug or info", level)
+	}
+	return nil
+}
+
+// debugf logs a message if debug logging is enabled.
+func debugf(format string, v ...interface{}) {
+	if debugLogging {
+		log.Printf("DEBUG: "+format, v...)
+	}
+}
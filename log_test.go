@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog returns the buffer the log output is written to until the end
+// of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestDebugTimings(t *testing.T) {
+	var rows []map[string]interface{}
+	for i := 0; i < 25; i++ {
+		rows = append(rows, node("n"+strconv.Itoa(i), 100))
+	}
+	stub := newChefStub(t, rows...)
+	e := newTestExporter(t, stub.URL, ExporterOpts{PageSize: 10})
+
+	buf := captureLog(t)
+	gather(t, e)
+	if strings.Contains(buf.String(), "DEBUG") {
+		t.Errorf("got debug output at the info level:\n%s", buf)
+	}
+
+	if err := setLogLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer setLogLevel("info")
+	buf.Reset()
+	mfs := gather(t, e)
+	for _, want := range []string{
+		"DEBUG: Search page at row 0 with 10 rows took ",
+		"DEBUG: Search page at row 10 with 10 rows took ",
+		"DEBUG: Search page at row 20 with 10 rows took ",
+		"DEBUG: Collector node took ",
+		"nodes=25",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("debug output lacks %q:\n%s", want, buf)
+		}
+	}
+	if v := gaugeValue(t, mfs, "chef_exporter_last_scrape_pages", nil); v != 3 {
+		t.Errorf("got %v pages, want 3", v)
+	}
+	if findMetric(mfs, "chef_exporter_search_slowest_page_seconds", nil) == nil {
+		t.Error("no chef_exporter_search_slowest_page_seconds")
+	}
+
+	if err := setLogLevel("trace"); err == nil {
+		t.Error("unknown log level accepted")
+	}
+}
+
+func TestScrapeSummary(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100), node("web02", 100), node("zombie", 180*24*3600))
+	e := newTestExporter(t, stub.URL, ExporterOpts{MaxAge: 30 * 24 * time.Hour})
+	buf := captureLog(t)
+	gather(t, e)
+
+	summary := regexp.MustCompile(`Scrape complete: collector=node nodes=2 skipped=1 duration=[0-9]+\.[0-9]{3}s up=1 partial=false\n`)
+	if matches := summary.FindAllString(buf.String(), -1); len(matches) != 1 {
+		t.Errorf("got %d summary lines, want one:\n%s", len(matches), buf)
+	}
+}
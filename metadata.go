@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nodeMetadata exports labels from a file kept outside Chef, such as the
+// team or cost center of each node, as chef_node_metadata. The file is a
+// JSON object of node names to label names to values:
+//
+//	{"web01": {"team": "frontend", "cost_center": "1234"}}
+//
+// Node metrics can be joined with it on the node label. Nodes without an
+// entry have no chef_node_metadata. The file can be reloaded while the
+// exporter runs.
+type nodeMetadata struct {
+	path  string
+	mutex sync.RWMutex
+	desc  *prometheus.Desc
+	// labelNames are the label names used by any node, so all series of
+	// chef_node_metadata have the same labels.
+	labelNames []string
+	nodes      map[string]map[string]string
+}
+
+func newNodeMetadata(path string) (*nodeMetadata, error) {
+	m := &nodeMetadata{path: path}
+	return m, m.load()
+}
+
+// load reads the metadata file. On error the current metadata is kept.
+func (m *nodeMetadata) load() error {
+	b, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var nodes map[string]map[string]string
+	if err := json.Unmarshal(b, &nodes); err != nil {
+		return fmt.Errorf("%s: %v", m.path, err)
+	}
+	seen := map[string]bool{}
+	var labelNames []string
+	for node, labels := range nodes {
+		for name := range labels {
+			if !validLabelName.MatchString(name) || strings.HasPrefix(name, "__") || name == "node" {
+				return fmt.Errorf("%s: invalid label name %q for node %s", m.path, name, node)
+			}
+			if !seen[name] {
+				seen[name] = true
+				labelNames = append(labelNames, name)
+			}
+		}
+	}
+	sort.Strings(labelNames)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nodes, m.labelNames = nodes, labelNames
+	m.desc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "metadata"),
+		"Always 1. The labels carry the metadata of the node from -metadata.file.",
+		append([]string{"node"}, labelNames...), nil,
+	)
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (m *nodeMetadata) Describe(ch chan<- *prometheus.Desc) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ch <- m.desc
+}
+
+// Collect implements prometheus.Collector.
+func (m *nodeMetadata) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for node, labels := range m.nodes {
+		values := []string{node}
+		for _, name := range m.labelNames {
+			values = append(values, labels[name])
+		}
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, 1, values...)
+	}
+}
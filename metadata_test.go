@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestNodeMetadata(t *testing.T) {
+	path := writeFile(t, "metadata.json", `{"web01": {"team": "frontend", "cost_center": "1234"}, "db01": {"team": "data"}}`)
+	metadata, err := newNodeMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs := gather(t, metadata)
+	for node, labels := range map[string]map[string]string{
+		"web01": {"team": "frontend", "cost_center": "1234"},
+		"db01":  {"team": "data", "cost_center": ""},
+	} {
+		labels["node"] = node
+		if findMetric(mfs, "chef_node_metadata", labels) == nil {
+			t.Errorf("no chef_node_metadata%v", labels)
+		}
+	}
+	if m := findMetric(mfs, "chef_node_metadata", map[string]string{"node": "web02"}); m != nil {
+		t.Errorf("node without metadata exported as %v", m)
+	}
+
+	// A reload with an invalid label name keeps the previous metadata.
+	if err := ioutil.WriteFile(path, []byte(`{"web01": {"node": "other"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := metadata.load(); err == nil {
+		t.Error("node label in the metadata accepted")
+	}
+	if mfs = gather(t, metadata); findMetric(mfs, "chef_node_metadata", map[string]string{"node": "web01", "team": "frontend"}) == nil {
+		t.Error("failed reload dropped the previous metadata")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// organizations lists the organizations on the Chef server, keyed by name
+// with their API URL as returned by the /organizations endpoint.
+func (e *Exporter) organizations(ctx context.Context) (map[string]string, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+	orgs := map[string]string{}
+	err = e.do(ctx, client, "GET", "/organizations", nil, &orgs)
+	return orgs, err
+}
+
+// orgExporters returns an exporter per organization, based on opts and
+// labelled with the organization name. Each exporter scrapes on its own, so
+// a failing organization only sets its own chef_up to 0.
+func orgExporters(opts ExporterOpts, orgs map[string]string) ([]*Exporter, error) {
+	names := make([]string, 0, len(orgs))
+	for name := range orgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var exporters []*Exporter
+	for _, name := range names {
+		o := opts
+		o.ChefServerURL = strings.TrimSuffix(orgs[name], "/") + "/"
+		o.SearchURL = ""
+		if o.StateFile != "" {
+			o.StateFile += "." + name
+		}
+		o.ConstLabels = prometheus.Labels{"org": name}
+		for k, v := range opts.ConstLabels {
+			o.ConstLabels[k] = v
+		}
+		e, err := NewExporter(o)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, e)
+	}
+	return exporters, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDiscoverOrgs(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100))
+	stub.mux.HandleFunc("/organizations", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"alpha":  stub.URL + "/organizations/alpha",
+			"broken": stub.URL + "/organizations/broken",
+		})
+	})
+	stub.mux.HandleFunc("/organizations/alpha/search/node", stub.search)
+	stub.mux.HandleFunc("/organizations/broken/search/node", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusBadRequest)
+	})
+
+	base := newTestExporter(t, stub.URL, ExporterOpts{})
+	orgs, err := base.organizations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporters, err := orgExporters(base.opts, orgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exporters) != 2 {
+		t.Fatalf("got %d exporters, want one per organization", len(exporters))
+	}
+	var cs []prometheus.Collector
+	for _, e := range exporters {
+		cs = append(cs, e)
+	}
+	mfs := gather(t, cs...)
+
+	for org, want := range map[string]float64{"alpha": 1, "broken": 0} {
+		if v := gaugeValue(t, mfs, "chef_up", map[string]string{"org": org}); v != want {
+			t.Errorf("got chef_up %v for %s, want %v", v, org, want)
+		}
+	}
+	if findMetric(mfs, "chef_node_time_since_ohai_seconds", map[string]string{"org": "alpha", "node": "web01"}) == nil {
+		t.Error("no series for the node of alpha")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-chef/chef"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OrphansCollector reports the nodes without an API client of the same name,
+// which can't run chef-client, and the clients without a node. The
+// organization validator clients, named <org>-validator, have no node by
+// design and are not counted.
+type OrphansCollector struct {
+	exporter *Exporter
+	nodes    *prometheus.Desc
+	clients  *prometheus.Desc
+}
+
+// NewOrphansCollector returns a collector using the Chef client of e.
+func NewOrphansCollector(e *Exporter) *OrphansCollector {
+	return &OrphansCollector{
+		exporter: e,
+		nodes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "orphan_nodes_total"),
+			"Number of nodes without an API client of the same name.",
+			nil, e.constLabels,
+		),
+		clients: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "orphan_clients_total"),
+			"Number of API clients, validators excepted, without a node of the same name.",
+			nil, e.constLabels,
+		),
+	}
+}
+
+// Name implements apiCollector.
+func (c *OrphansCollector) Name() string {
+	return "orphans"
+}
+
+// Describe implements apiCollector.
+func (c *OrphansCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nodes
+	ch <- c.clients
+}
+
+// Collect implements apiCollector. Nothing is exported when either list
+// can't be fetched.
+func (c *OrphansCollector) Collect(ctx context.Context, client *chef.Client, ch chan<- prometheus.Metric) error {
+	e := c.exporter
+	var nodes, clients map[string]string
+	if err := e.do(ctx, client, "GET", "nodes", nil, &nodes); err != nil {
+		return fmt.Errorf("couldn't list nodes: %w", err)
+	}
+	if err := e.do(ctx, client, "GET", "clients", nil, &clients); err != nil {
+		return fmt.Errorf("couldn't list clients: %w", err)
+	}
+	orphanNodes, orphanClients := 0, 0
+	for name := range nodes {
+		if _, ok := clients[name]; !ok {
+			orphanNodes++
+		}
+	}
+	for name := range clients {
+		if _, ok := nodes[name]; !ok && !strings.HasSuffix(name, "-validator") {
+			orphanClients++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.nodes, prometheus.GaugeValue, float64(orphanNodes))
+	ch <- prometheus.MustNewConstMetric(c.clients, prometheus.GaugeValue, float64(orphanClients))
+	return nil
+}
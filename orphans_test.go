@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOrphansCollector(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/nodes", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"web01":"` + stub.URL + `/nodes/web01","web02":"` + stub.URL + `/nodes/web02","db01":"` + stub.URL + `/nodes/db01"}`))
+	})
+	stub.mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"web01":"` + stub.URL + `/clients/web01","db01":"` + stub.URL + `/clients/db01","old01":"` + stub.URL + `/clients/old01","acme-validator":"` + stub.URL + `/clients/acme-validator"}`))
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewOrphansCollector(e)})
+
+	if v := gaugeValue(t, mfs, "chef_orphan_nodes_total", nil); v != 1 {
+		t.Errorf("got %v orphan nodes, want 1", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_orphan_clients_total", nil); v != 1 {
+		t.Errorf("got %v orphan clients, want 1 without the validator", v)
+	}
+}
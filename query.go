@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// binaryOperators are the Solr operators that need a term on both sides.
+var binaryOperators = map[string]bool{
+	"AND": true,
+	"OR":  true,
+	"&&":  true,
+	"||":  true,
+}
+
+// validateSearchQuery does a basic syntax check of a Chef search query:
+// quotes, parentheses and ranges must be balanced, ranges must use TO,
+// operators must have their operands, and words that look like operators
+// must be known ones: a lowercase "and" is searched for as a term. Positions in errors are 1-based byte
+// offsets into q. It doesn't catch everything the Chef server rejects,
+// but the common typos that would otherwise only show up at scrape time.
+func validateSearchQuery(q string) error {
+	type open struct {
+		c   byte
+		pos int
+	}
+	var stack []open
+	var tokens []string // tokens of the innermost group, for operator checks
+	var groups [][]string
+	var token strings.Builder
+	tokenStart := 0
+
+	endToken := func() error {
+		if token.Len() == 0 {
+			return nil
+		}
+		t := token.String()
+		token.Reset()
+		if err := checkOperator(t, tokenStart); err != nil {
+			return err
+		}
+		if binaryOperators[t] && (len(tokens) == 0 || isOperator(tokens[len(tokens)-1])) {
+			return fmt.Errorf("operator %s at position %d is missing its left operand", t, tokenStart+1)
+		}
+		tokens = append(tokens, t)
+		return nil
+	}
+	endGroup := func(pos int) error {
+		if len(tokens) > 0 && isOperator(tokens[len(tokens)-1]) {
+			return fmt.Errorf("operator %s before position %d is missing its right operand", tokens[len(tokens)-1], pos+1)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		inRange := len(stack) > 0 && (stack[len(stack)-1].c == '[' || stack[len(stack)-1].c == '{')
+		switch {
+		case c == '\\':
+			if token.Len() == 0 {
+				tokenStart = i
+			}
+			token.WriteByte(c)
+			if i+1 < len(q) {
+				i++
+				token.WriteByte(q[i])
+			}
+		case c == '"':
+			end := i + 1
+			for ; end < len(q) && q[end] != '"'; end++ {
+				if q[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(q) {
+				return fmt.Errorf("unterminated quote at position %d", i+1)
+			}
+			if token.Len() == 0 {
+				tokenStart = i
+			}
+			token.WriteString(q[i : end+1])
+			i = end
+		case c == '(' && !inRange, c == '[' || c == '{':
+			if err := endToken(); err != nil {
+				return err
+			}
+			stack = append(stack, open{c, i})
+			groups = append(groups, tokens)
+			tokens = nil
+		case c == ')' || c == ']' || c == '}':
+			if err := endToken(); err != nil {
+				return err
+			}
+			if len(stack) == 0 {
+				return fmt.Errorf("unbalanced %q at position %d", c, i+1)
+			}
+			o := stack[len(stack)-1]
+			if (o.c == '(') != (c == ')') {
+				return fmt.Errorf("%q at position %d doesn't match %q at position %d", c, i+1, o.c, o.pos+1)
+			}
+			if o.c == '(' {
+				if err := endGroup(i); err != nil {
+					return err
+				}
+				if len(tokens) == 0 {
+					return fmt.Errorf("empty group at position %d", o.pos+1)
+				}
+			} else if len(tokens) != 3 || tokens[1] != "TO" {
+				return fmt.Errorf("invalid range at position %d, expected [from TO to]", o.pos+1)
+			}
+			stack = stack[:len(stack)-1]
+			tokens = append(groups[len(groups)-1], q[o.pos:i+1])
+			groups = groups[:len(groups)-1]
+		case c == ' ' || c == '\t' || c == '\n':
+			if err := endToken(); err != nil {
+				return err
+			}
+		default:
+			if token.Len() == 0 {
+				tokenStart = i
+			}
+			token.WriteByte(c)
+		}
+	}
+	if err := endToken(); err != nil {
+		return err
+	}
+	if len(stack) > 0 {
+		o := stack[len(stack)-1]
+		return fmt.Errorf("unbalanced %q at position %d", o.c, o.pos+1)
+	}
+	return endGroup(len(q))
+}
+
+// checkOperator returns an error for a token that looks like an operator
+// but isn't one, such as "and" or "&".
+func checkOperator(t string, pos int) error {
+	if isOperator(t) {
+		return nil
+	}
+	if u := strings.ToUpper(t); isOperator(u) {
+		return fmt.Errorf("%s at position %d isn't an operator, operators are uppercase: %s", t, pos+1, u)
+	}
+	if strings.Trim(t, "&|!") == "" {
+		return fmt.Errorf("unknown operator %s at position %d", t, pos+1)
+	}
+	return nil
+}
+
+func isOperator(t string) bool {
+	return binaryOperators[t] || t == "NOT" || t == "!"
+}
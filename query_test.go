@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSearchQuery(t *testing.T) {
+	for _, q := range []string{
+		"*:*",
+		"role:web AND chef_environment:prod",
+		"(role:web OR role:db) AND NOT chef_environment:_default",
+		"ohai_time:[1600000000 TO *]",
+		`name:"web 01" OR name:web\(02\)`,
+		"platform:ubuntu && (platform_version:20.04 || platform_version:22.04)",
+		`role:web AND name:"and"`,
+		"!role:web",
+	} {
+		if err := validateSearchQuery(q); err != nil {
+			t.Errorf("%q: %v", q, err)
+		}
+	}
+
+	for q, want := range map[string]string{
+		"(role:web OR role:db":      `unbalanced '(' at position 1`,
+		"role:web)":                 `unbalanced ')' at position 9`,
+		`name:"web01`:               "unterminated quote at position 6",
+		"ohai_time:[1 TO *)":        `')' at position 18 doesn't match '[' at position 11`,
+		"ohai_time:[1 2]":           "invalid range at position 11",
+		"AND role:web":              "operator AND at position 1 is missing its left operand",
+		"role:web OR":               "operator OR before position 12 is missing its right operand",
+		"role:web AND OR role:db":   "operator OR at position 14 is missing its left operand",
+		"role:web AND ()":           "empty group at position 14",
+		"(role:web AND) OR role:db": "operator AND before position 14 is missing its right operand",
+		"role:web and role:db":      "and at position 10 isn't an operator, operators are uppercase: AND",
+		"role:web Or role:db":       "Or at position 10 isn't an operator",
+		"not role:web":              "not at position 1 isn't an operator",
+		"role:web & role:db":        "unknown operator & at position 10",
+		"role:web ||| role:db":      "unknown operator ||| at position 10",
+	} {
+		err := validateSearchQuery(q)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %s", q, err, want)
+		}
+	}
+}
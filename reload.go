@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configFile is a file reloaded on SIGHUP, named as in its log messages.
+type configFile struct {
+	name string
+	load func() error
+}
+
+// configReloader reloads the -labels.file and the -metadata.file together.
+// As a collector, it reports the outcome of the last reload of all of them,
+// so a reload fails if any file fails to load. The files are loaded when
+// the exporter starts, which it doesn't without them, so that first load
+// counts as a success.
+type configReloader struct {
+	mutex   sync.Mutex
+	files   []configFile
+	success prometheus.Gauge
+	time    prometheus.Gauge
+}
+
+func newConfigReloader() *configReloader {
+	r := &configReloader{
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_config_last_reload_success",
+			Help:      "1 if the last reload of the -labels.file and -metadata.file succeeded, 0 if the previous contents of a file were kept.",
+		}),
+		time: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_config_last_reload_timestamp_seconds",
+			Help:      "Time of the last attempt to reload the -labels.file and -metadata.file.",
+		}),
+	}
+	r.success.Set(1)
+	r.time.SetToCurrentTime()
+	return r
+}
+
+// add reloads the file named name with load.
+func (r *configReloader) add(name string, load func() error) {
+	r.files = append(r.files, configFile{name: name, load: load})
+}
+
+// reload loads every file, even after one failed, and reports whether all
+// of them loaded.
+func (r *configReloader) reload() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.time.SetToCurrentTime()
+	ok := true
+	for _, f := range r.files {
+		if err := f.load(); err != nil {
+			log.Printf("Couldn't reload %s file, keeping the previous %s: %v", f.name, f.name, err)
+			ok = false
+			continue
+		}
+		log.Printf("Reloaded %s file", f.name)
+	}
+	if ok {
+		r.success.Set(1)
+	} else {
+		r.success.Set(0)
+	}
+	return ok
+}
+
+// Describe implements prometheus.Collector.
+func (r *configReloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.success.Desc()
+	ch <- r.time.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (r *configReloader) Collect(ch chan<- prometheus.Metric) {
+	ch <- r.success
+	ch <- r.time
+}
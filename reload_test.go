@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestConfigReloader(t *testing.T) {
+	labelsPath := writeFile(t, "labels", "region=eu-west\n")
+	metadataPath := writeFile(t, "metadata.json", `{"web01": {"team": "frontend"}}`)
+	labels, err := newFileLabels(labelsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := newNodeMetadata(metadataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newConfigReloader()
+	r.add("labels", labels.load)
+	r.add("metadata", metadata.load)
+	check := func(success float64, since time.Time) {
+		t.Helper()
+		mfs := gather(t, r)
+		if v := gaugeValue(t, mfs, "chef_exporter_config_last_reload_success", nil); v != success {
+			t.Errorf("got chef_exporter_config_last_reload_success %v, want %v", v, success)
+		}
+		if v := gaugeValue(t, mfs, "chef_exporter_config_last_reload_timestamp_seconds", nil); v < float64(since.Unix()) {
+			t.Errorf("got chef_exporter_config_last_reload_timestamp_seconds %v before the reload at %v", v, since.Unix())
+		}
+	}
+	check(1, time.Now().Add(-time.Second))
+
+	write := func(path string, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A bad metadata file fails the reload although the labels loaded.
+	write(labelsPath, "region=us-east\n")
+	write(metadataPath, "{")
+	start := time.Now()
+	if r.reload() {
+		t.Error("reload with an invalid metadata file succeeded")
+	}
+	check(0, start)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metadata)
+	if mfs, _ := labels.gatherer(registry).Gather(); findMetric(mfs, "chef_node_metadata", map[string]string{"region": "us-east", "team": "frontend"}) == nil {
+		t.Error("the labels weren't reloaded, or the metadata wasn't kept")
+	}
+
+	write(labelsPath, "0zone=a\n")
+	write(metadataPath, `{"web01": {"team": "backend"}}`)
+	if r.reload() {
+		t.Error("reload with an invalid labels file succeeded")
+	}
+
+	write(labelsPath, "region=us-east\n")
+	start = time.Now()
+	if !r.reload() {
+		t.Error("reload of valid files failed")
+	}
+	check(1, start)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reportsRows caps the runs fetched from the Reporting API per scrape.
+const reportsRows = 10000
+
+// ReportsCollector reports the start time of the last chef-client run of
+// each node, from the run history of the Chef Reporting API. Unlike
+// ohai_time it is updated by every run. The runs of the whole organization
+// are fetched with a single request rather than one per node.
+type ReportsCollector struct {
+	exporter *Exporter
+	window   time.Duration
+	lastRun  *prometheus.Desc
+}
+
+// NewReportsCollector returns a collector using the Chef client of e and
+// looking at the runs started within window.
+func NewReportsCollector(e *Exporter, window time.Duration) *ReportsCollector {
+	return &ReportsCollector{
+		exporter: e,
+		window:   window,
+		lastRun: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "node", "last_report_timestamp_seconds"),
+			"Start time of the last chef-client run of the node reported to the Reporting API.",
+			[]string{"node"}, e.constLabels,
+		),
+	}
+}
+
+// Name implements apiCollector.
+func (c *ReportsCollector) Name() string {
+	return "reports"
+}
+
+// Describe implements apiCollector.
+func (c *ReportsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lastRun
+}
+
+// Collect implements apiCollector.
+func (c *ReportsCollector) Collect(ctx context.Context, client *chef.Client, ch chan<- prometheus.Metric) error {
+	runs, err := c.runs(ctx, client, time.Now())
+	if err != nil {
+		return fmt.Errorf("couldn't fetch the run history: %w", err)
+	}
+	for node, t := range runs {
+		ch <- prometheus.MustNewConstMetric(c.lastRun, prometheus.GaugeValue, float64(t.Unix()), node)
+	}
+	return nil
+}
+
+// runs returns the start time of the latest run of each node.
+func (c *ReportsCollector) runs(ctx context.Context, client *chef.Client, now time.Time) (map[string]time.Time, error) {
+	e := c.exporter
+	path := fmt.Sprintf("reports/org/runs?from=%d&until=%d&rows=%d", now.Add(-c.window).Unix(), now.Unix(), reportsRows)
+	req, err := client.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Ops-Reporting-Protocol-Version", "0.1.0")
+	var history struct {
+		RunHistory []struct {
+			NodeName  string `json:"node_name"`
+			StartTime string `json:"start_time"`
+		} `json:"run_history"`
+	}
+	if err := e.send(req, &history); err != nil {
+		return nil, err
+	}
+
+	runs := map[string]time.Time{}
+	for _, r := range history.RunHistory {
+		t, err := parseReportTime(r.StartTime)
+		if err != nil {
+			debugf("Skipping run of %s: %v", r.NodeName, err)
+			continue
+		}
+		if t.After(runs[r.NodeName]) {
+			runs[r.NodeName] = t
+		}
+	}
+	return runs, nil
+}
+
+// parseReportTime parses the UTC run times of the Reporting API, which
+// come with or without the RFC 3339 "T" and zone.
+func parseReportTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid run time %q", s)
+}
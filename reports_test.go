@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReportsCollector(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/reports/org/runs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Ops-Reporting-Protocol-Version") == "" {
+			http.Error(w, "missing protocol version", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"run_history":[
+			{"node_name":"web01","start_time":"2026-10-14 06:00:00"},
+			{"node_name":"web01","start_time":"2026-10-14T07:30:00Z"},
+			{"node_name":"db01","start_time":"2026-10-14 05:00:00"},
+			{"node_name":"bad","start_time":"yesterday"}
+		]}`))
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewReportsCollector(e, 24*time.Hour)})
+
+	for node, want := range map[string]string{"web01": "2026-10-14T07:30:00Z", "db01": "2026-10-14T05:00:00Z"} {
+		ts, _ := time.Parse(time.RFC3339, want)
+		if v := gaugeValue(t, mfs, "chef_node_last_report_timestamp_seconds", map[string]string{"node": node}); v != float64(ts.Unix()) {
+			t.Errorf("got a last run of %v for %s, want %s", v, node, want)
+		}
+	}
+	if m := findMetric(mfs, "chef_node_last_report_timestamp_seconds", map[string]string{"node": "bad"}); m != nil {
+		t.Errorf("exported the run with an invalid time: %v", m)
+	}
+
+	stub.mutex.Lock()
+	q := stub.requests[0].URL.Query()
+	stub.mutex.Unlock()
+	if q.Get("from") == "" || q.Get("until") == "" || q.Get("rows") == "" {
+		t.Errorf("runs requested with %v, want a single batch request for the window", q)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-chef/chef"
+)
+
+// sampledNode holds the per-node samples of a node from the last scrape
+// that sampled it.
+type sampledNode struct {
+	samples []stateSample
+	scrape  int
+}
+
+// sampleBatchSize is the number of node names per search fetching the
+// sampled nodes, to keep the queries short.
+const sampleBatchSize = 100
+
+// searchSample fetches the nodes sampled in this scrape with
+// -chef.sample-fraction. The names of all matching nodes are listed first,
+// which is cheap compared with fetching their attributes. A node belongs
+// to the sample numbered by nodeShard out of sampleRotation, so the
+// samples don't depend on the other nodes and each scrape takes the next
+// one: every node is fetched once per rotation. The attributes
+// of the sampled nodes are then fetched by name, and the aggregates that
+// can be are counted over all nodes with count-only searches.
+func (e *Exporter) searchSample(s *pagedSearch, query string) (chef.SearchResult, error) {
+	rotation := e.sampleRotation()
+	sample := e.sampleScrape % rotation
+	e.sampleScrape++
+	names, err := s.run(query, map[string]interface{}{"name": []string{"name"}})
+	if err != nil {
+		return chef.SearchResult{}, err
+	}
+	var sampled []string
+	for _, row := range names.Rows {
+		name, _ := rowData(row)["name"].(string)
+		if name != "" && nodeShard(name, rotation) == sample {
+			sampled = append(sampled, escapeQuery(name))
+		}
+	}
+	debugf("Sampled %d of %d nodes", len(sampled), len(names.Rows))
+	res := chef.SearchResult{Total: names.Total}
+	params := e.searchParams()
+	for i := 0; i < len(sampled); i += sampleBatchSize {
+		end := i + sampleBatchSize
+		if end > len(sampled) {
+			end = len(sampled)
+		}
+		batch := sampled[i:end]
+		page, err := s.run(fmt.Sprintf("(%s) AND name:(%s)", query, strings.Join(batch, " OR ")), params)
+		res.Rows = append(res.Rows, page.Rows...)
+		if err != nil {
+			return res, err
+		}
+	}
+	e.learnValues(res.Rows)
+	return res, e.countAggregates(s.ctx, s.client, query, names.Total)
+}
+
+// countedValues maps the partial search keys of the aggregates counted per
+// value while sampling to the search index fields holding them.
+var countedValues = map[string]string{
+	"chef_version":     "chef_packages_chef_version",
+	"policy_group":     "policy_group",
+	"chef_environment": "chef_environment",
+	"roles":            "roles",
+}
+
+// learnValues records the values of the counted aggregates found in the
+// sampled rows. They are kept until no node has them any more, so after a
+// rotation every value in the fleet is counted.
+func (e *Exporter) learnValues(rows []interface{}) {
+	for _, row := range rows {
+		data := rowData(row)
+		for key := range countedValues {
+			values := e.sampledValues[key]
+			if values == nil {
+				values = map[string]bool{}
+				e.sampledValues[key] = values
+			}
+			switch v := data[key].(type) {
+			case string:
+				if key == "chef_version" {
+					v = e.clientVersion(v)
+				}
+				if v != "" && v != "unknown" {
+					values[v] = true
+				}
+			case []interface{}:
+				for _, item := range v {
+					if s, ok := item.(string); ok {
+						values[s] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// countAggregates sets the aggregates that don't need the attributes of
+// every node from count-only searches, so they cover all nodes while
+// sampling: chef_nodes_checked_in_last_*, chef_nodes_missing_ohai_time,
+// chef_nodes_zombie, chef_nodes_future_ohai_total, the buckets of the Ohai
+// age histogram and the per-value aggregates. The other aggregates aren't
+// exported while sampling.
+func (e *Exporter) countAggregates(ctx context.Context, client *chef.Client, query string, total int) error {
+	now := time.Now().Unix()
+	count := func(q string) (int, error) {
+		res, err := e.searchPage(ctx, client, q, map[string]interface{}{"name": []string{"name"}}, 0, 0)
+		return res.Total, err
+	}
+	for _, w := range e.checkInWindows {
+		n, err := count(fmt.Sprintf("(%s) AND ohai_time:[%d TO *]", query, now-int64(w.window.Seconds())))
+		if err != nil {
+			return err
+		}
+		w.gauge.Set(float64(n))
+	}
+	withOhai, err := count(fmt.Sprintf("(%s) AND ohai_time:[* TO *]", query))
+	if err != nil {
+		return err
+	}
+	e.missingOhaiTime.Set(float64(total - withOhai))
+	zombies := 0
+	if e.maxAge > 0 {
+		if zombies, err = count(fmt.Sprintf("(%s) AND ohai_time:[* TO %d]", query, now-int64(e.maxAge.Seconds()))); err != nil {
+			return err
+		}
+	}
+	e.zombieNodes.Set(float64(zombies))
+	future, err := count(fmt.Sprintf("(%s) AND ohai_time:[%d TO *]", query, now+1))
+	if err != nil {
+		return err
+	}
+	e.futureNodes.Set(float64(future))
+	// Future nodes have an age of 0, so they are in every bucket.
+	e.sampledBuckets = make(map[float64]uint64, len(e.ohaiAgeBuckets))
+	for _, b := range e.ohaiAgeBuckets {
+		n, err := count(fmt.Sprintf("(%s) AND ohai_time:[%d TO *]", query, now-int64(b)))
+		if err != nil {
+			return err
+		}
+		e.sampledBuckets[b] = uint64(n)
+	}
+	e.sampledAged = withOhai
+	return e.countValues(count, query, total)
+}
+
+// countValues sets chef_nodes_by_client_version, chef_nodes_by_policy_group,
+// chef_environments_total and chef_roles_total with a count-only search per
+// value learned from the samples. Nodes whose client version isn't known
+// yet are counted as "unknown".
+func (e *Exporter) countValues(count func(string) (int, error), query string, total int) error {
+	counts := map[string]map[string]int{}
+	for key, field := range countedValues {
+		counts[key] = map[string]int{}
+		for value := range e.sampledValues[key] {
+			term := escapeQuery(value)
+			if key == "chef_version" && e.clientVersionMajor {
+				term += ".*"
+			}
+			n, err := count(fmt.Sprintf("(%s) AND %s:%s", query, field, term))
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				delete(e.sampledValues[key], value)
+				continue
+			}
+			counts[key][value] = n
+		}
+	}
+	known := 0
+	for version, n := range counts["chef_version"] {
+		e.clientVersions.WithLabelValues(version).Set(float64(n))
+		known += n
+	}
+	if total > known {
+		e.clientVersions.WithLabelValues("unknown").Set(float64(total - known))
+	}
+	for group, n := range counts["policy_group"] {
+		e.policyGroups.WithLabelValues(group).Set(float64(n))
+	}
+	e.environments.Set(float64(len(counts["chef_environment"])))
+	e.roles.Set(float64(len(counts["roles"])))
+	return nil
+}
+
+// sampleRotation is the number of scrapes it takes to sample every node.
+func (e *Exporter) sampleRotation() int {
+	return int(math.Ceil(1 / e.sampleFraction))
+}
+
+// carryOverSamples keeps exporting the nodes that were not sampled in this
+// scrape with the values of the last scrape that sampled them. Nodes not
+// sampled for a whole rotation, such as deleted nodes, are dropped.
+func (e *Exporter) carryOverSamples() {
+	current := map[string][]stateSample{}
+	for _, s := range e.snapshot() {
+		current[s.Labels["node"]] = append(current[s.Labels["node"]], s)
+	}
+	for node, samples := range current {
+		e.sampled[node] = sampledNode{samples: samples, scrape: e.sampleScrape}
+	}
+	for node, n := range e.sampled {
+		if _, ok := current[node]; ok {
+			continue
+		}
+		if e.sampleScrape-n.scrape >= e.sampleRotation() {
+			delete(e.sampled, node)
+			continue
+		}
+		e.restore(n.samples)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chef/chef"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServerStatusCollector reports the health of the Chef server components
+// from its unauthenticated /_status endpoint.
+type ServerStatusCollector struct {
+	exporter  *Exporter
+	up        *prometheus.Desc
+	component *prometheus.Desc
+}
+
+// NewServerStatusCollector returns a collector querying the /_status
+// endpoint of the server hosting the Chef server URL of e, with its HTTP
+// client.
+func NewServerStatusCollector(e *Exporter) *ServerStatusCollector {
+	// The org label doesn't apply to the server as a whole.
+	constLabels := prometheus.Labels{}
+	for k, v := range e.constLabels {
+		if k != "org" {
+			constLabels[k] = v
+		}
+	}
+	return &ServerStatusCollector{
+		exporter: e,
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "server", "status_up"),
+			"1 if the Chef server reports itself healthy on /_status.",
+			nil, constLabels,
+		),
+		component: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "server", "component_up"),
+			"1 if the Chef server reports the component healthy on /_status.",
+			[]string{"component"}, constLabels,
+		),
+	}
+}
+
+// Name implements apiCollector.
+func (c *ServerStatusCollector) Name() string {
+	return "server_status"
+}
+
+// Describe implements apiCollector.
+func (c *ServerStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.component
+}
+
+// usesClient implements clientUser: /_status needs no authentication.
+func (c *ServerStatusCollector) usesClient() bool {
+	return false
+}
+
+// Collect implements apiCollector. When the status can't be fetched,
+// chef_server_status_up is 0.
+func (c *ServerStatusCollector) Collect(ctx context.Context, _ *chef.Client, ch chan<- prometheus.Metric) error {
+	// The endpoint answers 500 with the same document when a component
+	// is down, so the body is decoded regardless of the status code.
+	var status struct {
+		Status    string                     `json:"status"`
+		Upstreams map[string]json.RawMessage `json:"upstreams"`
+	}
+	err := c.fetch(ctx, &status)
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return fmt.Errorf("couldn't fetch Chef server status: %w", err)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, statusValue(status.Status))
+	for name, raw := range status.Upstreams {
+		ch <- prometheus.MustNewConstMetric(c.component, prometheus.GaugeValue, componentValue(raw), name)
+	}
+	return nil
+}
+
+func (c *ServerStatusCollector) fetch(ctx context.Context, v interface{}) error {
+	u, err := url.Parse(c.exporter.chefServerUrl)
+	if err != nil {
+		return err
+	}
+	status := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/_status"}
+	req, err := http.NewRequest("GET", status.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.exporter.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return c.exporter.decodeResponse(res, v)
+}
+
+// componentValue handles both shapes used for upstreams across Chef server
+// versions: a plain status string ("pong") or an object with a status field.
+func componentValue(raw json.RawMessage) float64 {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return statusValue(s)
+	}
+	var obj struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(raw, &obj) == nil {
+		return statusValue(obj.Status)
+	}
+	return 0
+}
+
+func statusValue(s string) float64 {
+	if s == "pong" || s == "ok" {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestServerStatusCollector(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/_status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Ops-Authorization-1") != "" {
+			t.Error("/_status request is signed")
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"status":"fail","upstreams":{"chef_sql":"pong","chef_solr":"fail","chef_elasticsearch":{"status":"pong"},"oc_chef_authz":{"status":"timeout"}}}`))
+	})
+	e := newTestExporter(t, stub.URL+"/organizations/acme", ExporterOpts{})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewServerStatusCollector(e)})
+
+	if v := gaugeValue(t, mfs, "chef_server_status_up", nil); v != 0 {
+		t.Errorf("got chef_server_status_up %v with a failed component, want 0", v)
+	}
+	for component, want := range map[string]float64{"chef_sql": 1, "chef_solr": 0, "chef_elasticsearch": 1, "oc_chef_authz": 0} {
+		if v := gaugeValue(t, mfs, "chef_server_component_up", map[string]string{"component": component}); v != want {
+			t.Errorf("got %v for %s, want %v", v, component, want)
+		}
+	}
+}
+
+func TestServerStatusCollectorDown(t *testing.T) {
+	stub := newChefStub(t)
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewServerStatusCollector(e)})
+	if v := gaugeValue(t, mfs, "chef_server_status_up", nil); v != 0 {
+		t.Errorf("got chef_server_status_up %v without /_status, want 0", v)
+	}
+	if m := findMetric(mfs, "chef_server_component_up", nil); m != nil {
+		t.Errorf("got component %v without /_status", m)
+	}
+}
+
+func TestServerStatusCollectorMaxResponseBytes(t *testing.T) {
+	stub := newChefStub(t)
+	stub.mux.HandleFunc("/_status", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"pong","upstreams":{"chef_sql":"pong","chef_solr":"pong"}}`))
+	})
+	e := newTestExporter(t, stub.URL, ExporterOpts{MaxResponseBytes: 16})
+	mfs := gather(t, &chefCollector{exporter: e, collector: NewServerStatusCollector(e)})
+	if v := gaugeValue(t, mfs, "chef_server_status_up", nil); v != 0 {
+		t.Errorf("got chef_server_status_up %v for an oversized response, want 0", v)
+	}
+	if v := gaugeValue(t, gather(t, e.oversizedResponses), "chef_exporter_oversized_responses_total", nil); v != 1 {
+		t.Errorf("got %v oversized responses, want 1", v)
+	}
+}
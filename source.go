@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-chef/chef"
+)
+
+// readSearchFile reads the node search rows for -chef.source=file. The
+// file holds a JSON list of rows like the ones of a partial search
+// response, with the exporter's search keys:
+//
+//	[{"url": "...", "data": {"name": "web01", "ohai_time": 1700000000.5}}]
+//
+// The file is read on every scrape, so changes show up without a restart.
+func readSearchFile(path string) (chef.SearchResult, error) {
+	var res chef.SearchResult
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(b, &res.Rows); err != nil {
+		return res, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, row := range res.Rows {
+		if _, ok := rowData(row)["name"].(string); !ok {
+			return chef.SearchResult{}, fmt.Errorf("%s: row %d has no data object with a name", path, i)
+		}
+	}
+	res.Total = len(res.Rows)
+	return res, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// searchFile returns the -chef.file rows of nodes that ran Ohai age
+// seconds ago.
+func searchFile(ages map[string]float64) string {
+	var rows []string
+	for name, age := range ages {
+		rows = append(rows, fmt.Sprintf(`{"url": "http://chef/nodes/%s", "data": {"name": %q, "ohai_time": %f}}`, name, name, float64(time.Now().Unix())-age))
+	}
+	return "[" + strings.Join(rows, ",") + "]"
+}
+
+func TestSourceFile(t *testing.T) {
+	path := writeFile(t, "nodes.json", searchFile(map[string]float64{"web01": 100, "web02": 7200}))
+	// Nothing listens on the Chef server URL.
+	e := newTestExporter(t, "http://127.0.0.1:1", ExporterOpts{SourceFile: path, StaleThreshold: time.Hour})
+	mfs := gather(t, e)
+	if v := gaugeValue(t, mfs, "chef_up", nil); v != 1 {
+		t.Errorf("got chef_up %v, want 1", v)
+	}
+	for node, want := range map[string]float64{"web01": 100, "web02": 7200} {
+		if v := gaugeValue(t, mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": node}); math.Abs(v-want) > 5 {
+			t.Errorf("got an age of %v for %s, want %v", v, node, want)
+		}
+	}
+	if v := gaugeValue(t, mfs, "chef_node_status", map[string]string{"node": "web02"}); v != 0 {
+		t.Errorf("got status %v for the stale node, want 0", v)
+	}
+
+	// The file is read on every scrape.
+	if err := ioutil.WriteFile(path, []byte(searchFile(map[string]float64{"web03": 60})), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mfs = gather(t, e)
+	if findMetric(mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "web03"}) == nil {
+		t.Error("node added to the file not exported")
+	}
+	if m := findMetric(mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "web01"}); m != nil {
+		t.Errorf("node removed from the file exported as %v", m)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { t.Error("fleet handler called for ?node=") })
+	res, body := get(t, nodeHandler([]*Exporter{e}, nil, next), "/metrics?node=web03")
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `chef_node_time_since_ohai_seconds{node="web03"}`) {
+		t.Errorf("?node=web03 served status %d without its series:\n%s", res.StatusCode, body)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`[{"url": "http://chef/nodes/x", "data": {}}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v := gaugeValue(t, gather(t, e), "chef_up", nil); v != 0 {
+		t.Errorf("got chef_up %v for rows without a name, want 0", v)
+	}
+}
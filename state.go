@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stateSample is a single per-node sample saved in the state file.
+type stateSample struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// stateFile is the gzip compressed content of the state file. The checksum
+// covers the samples exactly as written.
+type stateFile struct {
+	SHA256  string          `json:"sha256"`
+	Samples json.RawMessage `json:"samples"`
+}
+
+// nodeVecs returns the per-node metrics, keyed by their name without the
+// "chef_node_" prefix.
+func (e *Exporter) nodeVecs() map[string]*prometheus.GaugeVec {
+	vecs := map[string]*prometheus.GaugeVec{
+		e.ohaiAgeName:              e.nodeMetrics[0],
+		"status":                   e.nodeStatus,
+		"ohai_time_present":        e.nodeOhaiPresent,
+		"scrape_timestamp_seconds": e.nodeScrapeTime,
+		"info":                     e.nodeInfo,
+	}
+	for _, a := range e.attributes {
+		vecs[a.key] = a.metric
+	}
+	return vecs
+}
+
+// snapshot returns the current values of the per-node metrics.
+func (e *Exporter) snapshot() []stateSample {
+	var samples []stateSample
+	for name, vec := range e.nodeVecs() {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			vec.Collect(ch)
+			close(ch)
+		}()
+		for m := range ch {
+			var pb dto.Metric
+			// NaN, the age of nodes without ohai_time, can't be
+			// encoded as JSON.
+			if err := m.Write(&pb); err != nil || math.IsNaN(pb.GetGauge().GetValue()) {
+				continue
+			}
+			s := stateSample{Metric: name, Labels: map[string]string{}, Value: pb.GetGauge().GetValue()}
+			for _, l := range pb.Label {
+				s.Labels[l.GetName()] = l.GetValue()
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// restore sets the per-node metrics to the given samples. Samples of
+// metrics that are no longer exported are ignored.
+func (e *Exporter) restore(samples []stateSample) {
+	vecs := e.nodeVecs()
+	for _, s := range samples {
+		// Earlier state files key the age by ohai_time.
+		if s.Metric == "ohai_time" {
+			s.Metric = e.ohaiAgeName
+		}
+		vec, ok := vecs[s.Metric]
+		if !ok {
+			continue
+		}
+		g, err := vec.GetMetricWith(s.Labels)
+		if err != nil {
+			continue
+		}
+		g.Set(s.Value)
+	}
+}
+
+// writeState writes samples to path. The file is written to a temporary
+// file first and renamed, so a crash never leaves a partial state file.
+func writeState(path string, samples []stateSample) error {
+	b, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	gz := gzip.NewWriter(tmp)
+	err = json.NewEncoder(gz).Encode(stateFile{SHA256: hex.EncodeToString(sum[:]), Samples: b})
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readState reads the samples written by writeState. Truncated or
+// otherwise corrupt files are reported as errors.
+func readState(path string) ([]stateSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var state stateFile
+	if err := json.NewDecoder(gz).Decode(&state); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(state.Samples)
+	if hex.EncodeToString(sum[:]) != state.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch in %s", path)
+	}
+	var samples []stateSample
+	err = json.Unmarshal(state.Samples, &samples)
+	return samples, err
+}
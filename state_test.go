@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateFileWarmStart(t *testing.T) {
+	path := filepath.Join(tempDir(t), "state")
+	stub := newChefStub(t, node("web01", 100))
+	e := newTestExporter(t, stub.URL, ExporterOpts{StateFile: path})
+	gather(t, e)
+
+	// The restarted exporter can't reach the Chef server at first.
+	down := true
+	stub.mux.HandleFunc("/organizations/restarted/search/node", func(w http.ResponseWriter, r *http.Request) {
+		stub.mutex.Lock()
+		failing := down
+		stub.mutex.Unlock()
+		if failing {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		stub.search(w, r)
+	})
+	e = newTestExporter(t, stub.URL+"/organizations/restarted", ExporterOpts{StateFile: path})
+	mfs := gather(t, e)
+	if v := gaugeValue(t, mfs, "chef_up", nil); v != 0 {
+		t.Fatalf("got chef_up %v, want 0", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "web01"}); v < 100 || v > 110 {
+		t.Errorf("got a restored Ohai age of %v, want about 100", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_exporter_state_stale", nil); v != 1 {
+		t.Errorf("got chef_exporter_state_stale %v, want 1", v)
+	}
+
+	stub.mutex.Lock()
+	down = false
+	stub.mutex.Unlock()
+	stub.setRows(node("web02", 100))
+	mfs = gather(t, e)
+	if v := gaugeValue(t, mfs, "chef_exporter_state_stale", nil); v != 0 {
+		t.Errorf("got chef_exporter_state_stale %v after a fresh scrape, want 0", v)
+	}
+	if m := findMetric(mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "web01"}); m != nil {
+		t.Error("fresh scrape still serves the restored node")
+	}
+}
+
+func TestStateFileIntegrity(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "state")
+	samples := []stateSample{{Metric: "status", Labels: map[string]string{"node": "web01"}, Value: 1}}
+	if err := writeState(path, samples); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, samples) {
+		t.Errorf("read %v, want %v", got, samples)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %d files after writing the state, want no temporary file left", len(files))
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated")
+	if err := ioutil.WriteFile(truncated, b[:len(b)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readState(truncated); err == nil {
+		t.Error("truncated state file read without error")
+	}
+
+	// A valid gzip stream with samples not matching the checksum.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	json.NewEncoder(gz).Encode(stateFile{SHA256: "0000", Samples: json.RawMessage(`[]`)})
+	gz.Close()
+	tampered := filepath.Join(dir, "tampered")
+	if err := ioutil.WriteFile(tampered, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readState(tampered); err == nil {
+		t.Error("state file with a bad checksum read without error")
+	}
+
+	// An exporter starting with a corrupt file starts empty.
+	stub := newChefStub(t)
+	e := newTestExporter(t, stub.URL, ExporterOpts{StateFile: truncated})
+	if e.warmState != nil {
+		t.Errorf("restored %v from a truncated state file", e.warmState)
+	}
+}
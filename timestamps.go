@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxSourceTimestampAge is how far in the past source timestamps may be.
+// Prometheus rejects samples much older than its head block, so older
+// timestamps are clamped to it.
+const maxSourceTimestampAge = time.Hour
+
+// timestampedMetric sets an explicit timestamp on a metric.
+type timestampedMetric struct {
+	prometheus.Metric
+	timestampMs int64
+}
+
+// Write implements prometheus.Metric.
+func (m timestampedMetric) Write(pb *dto.Metric) error {
+	if err := m.Metric.Write(pb); err != nil {
+		return err
+	}
+	pb.TimestampMs = proto.Int64(m.timestampMs)
+	return nil
+}
+
+// sourceTimeKey identifies a node by its node label values.
+func sourceTimeKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// collectWithSourceTimestamps collects vec, timestamping the metrics of
+// nodes with a recorded ohai_time with it.
+func (e *Exporter) collectWithSourceTimestamps(vec *prometheus.GaugeVec, ch chan<- prometheus.Metric) {
+	in := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(in)
+		close(in)
+	}()
+	for m := range in {
+		var pb dto.Metric
+		if err := m.Write(&pb); err == nil {
+			labels := make(map[string]string, len(pb.Label))
+			for _, l := range pb.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			values := make([]string, len(e.nodeLabelNames))
+			for i, name := range e.nodeLabelNames {
+				values[i] = labels[name]
+			}
+			if ts, ok := e.sourceTimes[sourceTimeKey(values)]; ok {
+				m = timestampedMetric{Metric: m, timestampMs: ts}
+			}
+		}
+		ch <- m
+	}
+}
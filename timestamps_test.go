@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceTimestamps(t *testing.T) {
+	ohaiTime := float64(time.Now().Unix() - 100)
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "recent", "ohai_time": ohaiTime},
+		node("old", 2*3600),
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{SourceTimestamps: true, StaleThreshold: time.Hour})
+	start := time.Now()
+	mfs := gather(t, e)
+
+	m := findMetric(mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "recent"})
+	if m == nil || m.GetTimestampMs() != int64(ohaiTime)*1000 {
+		t.Errorf("age of recent isn't timestamped with its ohai_time: %v", m)
+	}
+	if v := gaugeValue(t, mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "recent"}); v < 95 || v > 105 {
+		t.Errorf("got an age of %v for recent, want 100", v)
+	}
+	if m := findMetric(mfs, "chef_node_status", map[string]string{"node": "recent"}); m == nil || m.TimestampMs != nil {
+		t.Errorf("chef_node_status of recent isn't on the scrape time: %v", m)
+	}
+
+	m = findMetric(mfs, "chef_node_time_since_ohai_seconds", map[string]string{"node": "old"})
+	if m == nil {
+		t.Fatal("no age for old")
+	}
+	oldest := start.Add(-maxSourceTimestampAge).UnixNano() / 1e6
+	if ts := m.GetTimestampMs(); ts < oldest-1000 || ts > time.Now().Add(-maxSourceTimestampAge).UnixNano()/1e6 {
+		t.Errorf("got timestamp %d for old, want it clamped to %s ago", ts, maxSourceTimestampAge)
+	}
+	if v := m.Gauge.GetValue(); v < 7190 || v > 7210 {
+		t.Errorf("got an age of %v for old, want 7200", v)
+	}
+	// old ran Ohai twice the stale threshold ago.
+	if v := gaugeValue(t, mfs, "chef_node_status", map[string]string{"node": "old"}); v != 0 {
+		t.Errorf("got status %v for old, want 0", v)
+	}
+
+	e = newTestExporter(t, stub.URL, ExporterOpts{})
+	if m := findMetric(gather(t, e), "chef_node_time_since_ohai_seconds", map[string]string{"node": "recent"}); m.TimestampMs != nil {
+		t.Errorf("got timestamp %d without -metric.use-source-timestamp", m.GetTimestampMs())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSMinVersion(t *testing.T) {
+	cfg, err := newTLSConfig("1.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = cfg
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(version uint16) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+		}}}
+		res, err := client.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	if err := get(tls.VersionTLS10); err == nil {
+		t.Error("TLS 1.0 handshake succeeded with -web.tls-min-version=1.2")
+	}
+	if err := get(tls.VersionTLS12); err != nil {
+		t.Errorf("TLS 1.2 handshake failed: %v", err)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	if _, err := newTLSConfig("1.4", ""); err == nil {
+		t.Error("unknown TLS version accepted")
+	}
+	if _, err := newTLSConfig("1.2", "TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Error("insecure cipher suite accepted")
+	}
+	cfg, err := newTLSConfig("1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.CipherSuites) != 2 || cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("got cipher suites %v", cfg.CipherSuites)
+	}
+}
+
+// newNamedCert returns a self-signed certificate valid only for name,
+// until notAfter.
+func newNamedCert(t *testing.T, name string, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSServerName(t *testing.T) {
+	cert := newNamedCert(t, "chef.internal", time.Now().Add(time.Hour))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(parsed)
+
+	get := func(serverName string) error {
+		cfg, err := newTLSConfig("1.2", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.RootCAs, cfg.ServerName = roots, serverName
+		res, err := newChefHTTPClient(cfg, nil, nil, newConnStats(1)).Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	if err := get(""); err == nil {
+		t.Error("certificate for chef.internal accepted for the dial host")
+	}
+	if err := get("chef.internal"); err != nil {
+		t.Errorf("handshake with -chef.tls-server-name=chef.internal failed: %v", err)
+	}
+}
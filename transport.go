@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newChefHTTPClient returns the HTTP client used for all Chef API requests.
+// It mirrors the transport go-chef sets up internally, but with our own TLS
+// settings. Connections to the hosts in resolve go to the given IP instead
+// of the resolved address. The given headers are added to every request.
+// Connection usage is recorded in stats.
+//
+// Compression is left to the transport: it asks for gzip and transparently
+// decompresses search responses, which shrinks them considerably on large
+// fleets. Setting Accept-Encoding on the requests would disable that. The
+// header is not part of the Chef request signature.
+func newChefHTTPClient(tlsConfig *tls.Config, resolve map[string]string, headers http.Header, stats *connStats) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, port, err := net.SplitHostPort(addr); err == nil {
+				if ip, ok := resolve[host]; ok {
+					addr = net.JoinHostPort(ip, port)
+				}
+			}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return stats.track(conn), nil
+		},
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        stats.maxIdle,
+		MaxIdleConnsPerHost: stats.maxIdle,
+	}
+	if len(headers) > 0 {
+		transport = &headerTransport{headers: headers, next: transport}
+	}
+	return &http.Client{Transport: &statsTransport{stats: stats, next: transport}}
+}
+
+// connStats counts the connections of the Chef HTTP client, to show how
+// well they are reused. The transport does not report its pool, so idle
+// connections are estimated as the open ones without a request in flight.
+type connStats struct {
+	maxIdle  int
+	open     int64
+	inFlight int64
+	dials    uint64
+	reuses   uint64
+	// responseBytes are the bytes of response bodies read, after
+	// decompression by the transport.
+	responseBytes uint64
+
+	certMutex sync.Mutex
+	certs     map[string]serverCert
+
+	maxIdleDesc  *prometheus.Desc
+	openDesc     *prometheus.Desc
+	idleDesc     *prometheus.Desc
+	dialsDesc    *prometheus.Desc
+	reusesDesc   *prometheus.Desc
+	inFlightDesc *prometheus.Desc
+	bytesDesc    *prometheus.Desc
+	expiryDesc   *prometheus.Desc
+	validDesc    *prometheus.Desc
+}
+
+// serverCert is the certificate a Chef server presented in the last TLS
+// handshake with it.
+type serverCert struct {
+	notAfter time.Time
+	verified bool
+}
+
+func newConnStats(maxIdle int) *connStats {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", name), help, nil, nil)
+	}
+	return &connStats{
+		maxIdle:      maxIdle,
+		maxIdleDesc:  desc("http_max_idle_conns", "Maximum number of idle connections kept to the Chef server."),
+		openDesc:     desc("http_open_conns", "Number of open connections to the Chef server."),
+		idleDesc:     desc("http_idle_conns", "Number of open connections to the Chef server without a request in flight."),
+		inFlightDesc: desc("http_requests_in_flight", "Number of Chef API requests in flight."),
+		dialsDesc:    desc("http_dials_total", "Number of connections opened to the Chef server."),
+		reusesDesc:   desc("http_conn_reuses_total", "Number of Chef API requests sent over an already open connection."),
+		bytesDesc:    desc("api_response_bytes_total", "Bytes of Chef API response bodies read, after decompression."),
+		certs:        map[string]serverCert{},
+		expiryDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "server", "cert_expiry_timestamp_seconds"),
+			"Expiry time of the certificate presented by the Chef server in the last TLS handshake.",
+			[]string{"server"}, nil,
+		),
+		validDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "server", "cert_valid"),
+			"1 if the certificate presented by the Chef server in the last TLS handshake was verified and not expired, 0 otherwise.",
+			[]string{"server"}, nil,
+		),
+	}
+}
+
+// track returns conn, counted as open until it is closed.
+func (s *connStats) track(conn net.Conn) net.Conn {
+	atomic.AddUint64(&s.dials, 1)
+	atomic.AddInt64(&s.open, 1)
+	return &trackedConn{Conn: conn, stats: s}
+}
+
+// handshakeDone records the certificate presented in a TLS handshake with
+// server. Certificates are only seen on new connections, so the last one
+// seen is kept. A handshake failing verification doesn't expose the
+// certificate, only that it is invalid.
+func (s *connStats) handshakeDone(server string, state tls.ConnectionState, err error) {
+	s.certMutex.Lock()
+	defer s.certMutex.Unlock()
+	c := s.certs[server]
+	c.verified = err == nil && len(state.VerifiedChains) > 0
+	if len(state.PeerCertificates) > 0 {
+		c.notAfter = state.PeerCertificates[0].NotAfter
+	}
+	s.certs[server] = c
+}
+
+// Describe implements prometheus.Collector.
+func (s *connStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.maxIdleDesc
+	ch <- s.openDesc
+	ch <- s.idleDesc
+	ch <- s.inFlightDesc
+	ch <- s.dialsDesc
+	ch <- s.reusesDesc
+	ch <- s.bytesDesc
+	ch <- s.expiryDesc
+	ch <- s.validDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *connStats) Collect(ch chan<- prometheus.Metric) {
+	open, inFlight := atomic.LoadInt64(&s.open), atomic.LoadInt64(&s.inFlight)
+	idle := open - inFlight
+	if idle < 0 {
+		idle = 0
+	}
+	ch <- prometheus.MustNewConstMetric(s.maxIdleDesc, prometheus.GaugeValue, float64(s.maxIdle))
+	ch <- prometheus.MustNewConstMetric(s.openDesc, prometheus.GaugeValue, float64(open))
+	ch <- prometheus.MustNewConstMetric(s.idleDesc, prometheus.GaugeValue, float64(idle))
+	ch <- prometheus.MustNewConstMetric(s.inFlightDesc, prometheus.GaugeValue, float64(inFlight))
+	ch <- prometheus.MustNewConstMetric(s.dialsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&s.dials)))
+	ch <- prometheus.MustNewConstMetric(s.reusesDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&s.reuses)))
+	ch <- prometheus.MustNewConstMetric(s.bytesDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&s.responseBytes)))
+
+	now := time.Now()
+	s.certMutex.Lock()
+	defer s.certMutex.Unlock()
+	for server, c := range s.certs {
+		valid := 0.0
+		if c.verified && now.Before(c.notAfter) {
+			valid = 1
+		}
+		if !c.notAfter.IsZero() {
+			ch <- prometheus.MustNewConstMetric(s.expiryDesc, prometheus.GaugeValue, float64(c.notAfter.Unix()), server)
+		}
+		ch <- prometheus.MustNewConstMetric(s.validDesc, prometheus.GaugeValue, valid, server)
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.stats.open, -1) })
+	return c.Conn.Close()
+}
+
+// statsTransport counts the requests in flight, until their response body
+// is closed, the ones reusing a connection and the bytes of the response
+// bodies. It also records the server certificates of new TLS connections.
+type statsTransport struct {
+	stats *connStats
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&t.stats.reuses, 1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.stats.handshakeDone(req.URL.Host, state, err)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	atomic.AddInt64(&t.stats.inFlight, 1)
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&t.stats.inFlight, -1)
+		return nil, err
+	}
+	counter, _ := req.Context().Value(responseBytesKey{}).(*uint64)
+	res.Body = &inFlightBody{ReadCloser: res.Body, stats: t.stats, counter: counter}
+	return res, nil
+}
+
+type responseBytesKey struct{}
+
+// withResponseBytes returns a context whose requests also add the bytes of
+// their response bodies to n.
+func withResponseBytes(ctx context.Context, n *uint64) context.Context {
+	return context.WithValue(ctx, responseBytesKey{}, n)
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	stats   *connStats
+	counter *uint64
+	once    sync.Once
+}
+
+func (b *inFlightBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddUint64(&b.stats.responseBytes, uint64(n))
+	if b.counter != nil {
+		atomic.AddUint64(b.counter, uint64(n))
+	}
+	return n, err
+}
+
+func (b *inFlightBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.stats.inFlight, -1) })
+	return b.ReadCloser.Close()
+}
+
+// headerTransport adds extra headers, such as gateway API keys, to every
+// request. Headers already set on a request, including the signature
+// headers added by go-chef, are left as they are.
+type headerTransport struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		if _, ok := req.Header[name]; !ok {
+			req.Header[name] = values
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+var validHeaderName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// parseHeaders parses "Name: Value" headers as given to -chef.header. The
+// X-Ops-* headers carrying the request signature can't be overridden.
+func parseHeaders(values []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, v := range values {
+		i := strings.Index(v, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid -chef.header %q, expected \"Name: Value\"", v)
+		}
+		name, value := strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])
+		if !validHeaderName.MatchString(name) || value == "" {
+			return nil, fmt.Errorf("invalid -chef.header %q, expected \"Name: Value\"", v)
+		}
+		if strings.HasPrefix(strings.ToLower(name), "x-ops-") {
+			return nil, fmt.Errorf("-chef.header can't set the signature header %s", name)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// parseResolve parses host:ip overrides as given to -chef.resolve.
+func parseResolve(values []string) (map[string]string, error) {
+	resolve := map[string]string{}
+	for _, v := range values {
+		i := strings.Index(v, ":")
+		if i <= 0 || net.ParseIP(v[i+1:]) == nil {
+			return nil, fmt.Errorf("invalid -chef.resolve %q, expected host:ip", v)
+		}
+		resolve[v[:i]] = v[i+1:]
+	}
+	return resolve, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveOverride(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newChefHTTPClient(nil, map[string]string{"chef.invalid": "127.0.0.1"}, nil, newConnStats(1))
+	// The overridden host must not go to a proxy from the environment.
+	client.Transport.(*statsTransport).next.(*http.Transport).Proxy = nil
+	res, err := client.Get("http://chef.invalid:" + port + "/")
+	if err != nil {
+		t.Fatalf("request to the overridden host failed: %v", err)
+	}
+	res.Body.Close()
+	if host != "chef.invalid:"+port {
+		t.Errorf("server got Host %q, want the configured host", host)
+	}
+}
+
+func TestGzipSearchResponse(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100), node("web02", 100))
+	stub.mux.HandleFunc("/organizations/gzip/search/node", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("search request has Accept-Encoding %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		if r.Header.Get("X-Ops-Authorization-1") == "" {
+			t.Error("search request isn't signed")
+		}
+		rec := httptest.NewRecorder()
+		stub.search(rec, r)
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(rec.Body.Bytes())
+		gz.Close()
+	})
+	e := newTestExporter(t, stub.URL+"/organizations/gzip", ExporterOpts{HTTPClient: newChefHTTPClient(nil, nil, nil, newConnStats(1))})
+	mfs := gather(t, e)
+	if v := gaugeValue(t, mfs, "chef_up", nil); v != 1 {
+		t.Fatalf("got chef_up %v for a gzip-encoded response, want 1", v)
+	}
+	if v := gaugeValue(t, mfs, "chef_nodes_matching", nil); v != 2 {
+		t.Errorf("got %v nodes, want 2", v)
+	}
+}
+
+func TestChefHeaders(t *testing.T) {
+	headers, err := parseHeaders([]string{"X-Api-Key: secret", "X-Tenant:acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t, node("web01", 100))
+	e := newTestExporter(t, stub.URL, ExporterOpts{HTTPClient: newChefHTTPClient(nil, nil, headers, newConnStats(1))})
+	gather(t, e)
+
+	stub.mutex.Lock()
+	r := stub.requests[0]
+	stub.mutex.Unlock()
+	if r.Header.Get("X-Api-Key") != "secret" || r.Header.Get("X-Tenant") != "acme" {
+		t.Errorf("request has headers %v, want the custom ones", r.Header)
+	}
+	if r.Header.Get("X-Ops-Userid") != "test" || r.Header.Get("X-Ops-Authorization-1") == "" {
+		t.Error("custom headers replaced the signature headers")
+	}
+
+	for _, bad := range []string{"X-Api-Key", "Bad Name: x", "X-Empty:", "X-Ops-Userid: admin"} {
+		if _, err := parseHeaders([]string{bad}); err == nil {
+			t.Errorf("invalid header %q accepted", bad)
+		}
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	var rows []map[string]interface{}
+	for i := 0; i < 30; i++ {
+		rows = append(rows, node("n"+strconv.Itoa(i), 100))
+	}
+	stub := newChefStub(t, rows...)
+	stats := newConnStats(5)
+	e := newTestExporter(t, stub.URL, ExporterOpts{PageSize: 10, HTTPClient: newChefHTTPClient(nil, nil, nil, stats)})
+	gather(t, e)
+
+	mfs := gather(t, stats)
+	want := map[string]float64{
+		"chef_exporter_http_max_idle_conns":     5,
+		"chef_exporter_http_open_conns":         1,
+		"chef_exporter_http_idle_conns":         1,
+		"chef_exporter_http_requests_in_flight": 0,
+		"chef_exporter_http_dials_total":        1,
+		// The three pages share one connection.
+		"chef_exporter_http_conn_reuses_total": 2,
+	}
+	for name, v := range want {
+		if got := gaugeValue(t, mfs, name, nil); got != v {
+			t.Errorf("got %s %v, want %v", name, got, v)
+		}
+	}
+}
+
+func TestServerCert(t *testing.T) {
+	// Certificates only carry whole seconds.
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	for _, c := range []struct {
+		notAfter time.Time
+		valid    float64
+		expiry   bool
+	}{
+		{notAfter, 1, true},
+		// An expired certificate fails verification, which doesn't expose
+		// it.
+		{time.Now().Add(-time.Minute), 0, false},
+	} {
+		cert := newNamedCert(t, "chef.internal", c.notAfter)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		defer server.Close()
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(parsed)
+
+		stats := newConnStats(1)
+		res, err := newChefHTTPClient(&tls.Config{RootCAs: roots, ServerName: "chef.internal"}, nil, nil, stats).Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		mfs := gather(t, stats)
+		host := strings.TrimPrefix(server.URL, "https://")
+		labels := map[string]string{"server": host}
+		if v := gaugeValue(t, mfs, "chef_server_cert_valid", labels); v != c.valid {
+			t.Errorf("certificate expiring at %v: got chef_server_cert_valid %v, want %v", c.notAfter, v, c.valid)
+		}
+		m := findMetric(mfs, "chef_server_cert_expiry_timestamp_seconds", labels)
+		if !c.expiry {
+			if m != nil {
+				t.Errorf("certificate expiring at %v: exported an expiry of %v", c.notAfter, m)
+			}
+			continue
+		}
+		if m == nil || m.Gauge.GetValue() != float64(notAfter.Unix()) {
+			t.Errorf("got chef_server_cert_expiry_timestamp_seconds %v, want %d", m, notAfter.Unix())
+		}
+	}
+}
+
+func TestResponseBytes(t *testing.T) {
+	var rows []map[string]interface{}
+	for i := 0; i < 25; i++ {
+		rows = append(rows, node("n"+strconv.Itoa(i), 100))
+	}
+	stub := newChefStub(t, rows...)
+	var mutex sync.Mutex
+	sent := 0
+	stub.mux.HandleFunc("/organizations/sized/search/node", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		n, _ := strconv.Atoi(r.URL.Query().Get("rows"))
+		b, err := json.Marshal(map[string]interface{}{"total": len(rows), "start": start, "rows": page(rows, start, n)})
+		if err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		sent += len(b)
+		mutex.Unlock()
+		w.Write(b)
+	})
+	stats := newConnStats(1)
+	e := newTestExporter(t, stub.URL+"/organizations/sized", ExporterOpts{PageSize: 10, HTTPClient: newChefHTTPClient(nil, nil, nil, stats)})
+
+	for scrape := 1; scrape <= 2; scrape++ {
+		mutex.Lock()
+		sent = 0
+		mutex.Unlock()
+		mfs := gather(t, e)
+		total := gaugeValue(t, gather(t, stats), "chef_exporter_api_response_bytes_total", nil)
+		mutex.Lock()
+		perScrape := float64(sent)
+		mutex.Unlock()
+		if v := gaugeValue(t, mfs, "chef_exporter_last_scrape_response_bytes", nil); v != perScrape {
+			t.Errorf("scrape %d: got chef_exporter_last_scrape_response_bytes %v, want %v", scrape, v, perScrape)
+		}
+		if total != float64(scrape)*perScrape {
+			t.Errorf("scrape %d: got chef_exporter_api_response_bytes_total %v, want %v", scrape, total, float64(scrape)*perScrape)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// validNodeName matches the node names accepted by the Chef server.
+var validNodeName = regexp.MustCompile(`^[a-zA-Z0-9_\-.:]+$`)
+
+// listen listens on a TCP address, or on a Unix socket for addresses of the
+// form unix:/path. The socket is readable and writable by the owner and
+// group only, and removed when the listener is closed.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix:")
+	// A socket left behind by a killed exporter would make Listen fail,
+	// but one another exporter still listens on must be left alone.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// webPaths returns the parsed -web.external-url, the path the links start
+// with and the prefix of the served paths. Behind a reverse proxy, links
+// are relative to the external URL and the paths may keep the proxy's
+// prefix, which defaults to the path of the external URL.
+func webPaths(externalURL string, routePrefix string) (*url.URL, string, string, error) {
+	externalPath := ""
+	var external *url.URL
+	if externalURL != "" {
+		var err error
+		if external, err = url.Parse(externalURL); err != nil {
+			return nil, "", "", fmt.Errorf("invalid -web.external-url: %v", err)
+		}
+		externalPath = strings.TrimSuffix(external.Path, "/")
+	}
+	prefix := externalPath
+	if routePrefix != "" {
+		prefix = strings.TrimSuffix(routePrefix, "/")
+	}
+	// Without a proxy rewriting the paths, the links start with the prefix.
+	if externalPath == "" {
+		externalPath = prefix
+	}
+	return external, externalPath, prefix, nil
+}
+
+// landingPage returns the handler of the landing page, linking to the
+// metrics at metricsLink.
+func landingPage(metricsLink string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+             <head><title>Chef Exporter</title></head>
+             <body>
+             <h1>Chef Exporter</h1>
+             <p><a href='` + metricsLink + `'>Metrics</a></p>
+             </body>
+             </html>`))
+	})
+}
+
+// withRoutePrefix returns a handler serving the paths of next under prefix,
+// e.g. /metrics as /chef-exporter/metrics. An empty prefix returns next.
+func withRoutePrefix(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusFound)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// handlerFor returns an HTTP handler exposing the metrics of g.
+func handlerFor(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := g.Gather()
+		writeMetrics(w, r, mfs, err)
+	})
+}
+
+// cachedHandler returns an HTTP handler exposing the metrics of c, gathered
+// at most once per its ttl. Responses served from the cache have an Age
+// header. With a ttl, the responses also carry the cache hits and misses,
+// which are gathered on every request so they aren't cached themselves.
+func cachedHandler(c *cachedGatherer) http.Handler {
+	registry := prometheus.NewRegistry()
+	if c.ttl > 0 {
+		registry.MustRegister(c.hits, c.misses, c.age)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, age, cached, err := c.gather(time.Now(), c.ttl)
+		if cached {
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+		}
+		if err == nil {
+			mfs, err = prometheus.Gatherers{
+				prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil }),
+				registry,
+			}.Gather()
+		}
+		writeMetrics(w, r, mfs, err)
+	})
+}
+
+// limitRequests returns an HTTP handler passing at most max concurrent
+// requests on to next, so a stampede of scrapes doesn't pile up searches
+// on the Chef server. Requests beyond the limit get a 503 right away. A
+// max of 0 disables the limit.
+func limitRequests(next http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	inFlight := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "too many concurrent metrics requests", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// metricsMux returns a mux serving the metrics handler h at path and at
+// each of aliases, such as the path of dashboards not yet migrated.
+func metricsMux(h http.Handler, path string, aliases []string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+	for _, alias := range aliases {
+		mux.Handle(alias, h)
+	}
+	return mux
+}
+
+// disableDefaultCollectors replaces the default registry, which comes with
+// the go_* and process_* metrics, with an empty one.
+func disableDefaultCollectors() {
+	registry := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer = registry
+	prometheus.DefaultGatherer = registry
+}
+
+// handlePprof serves the Go runtime profiles of net/http/pprof on mux.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// writeMetrics writes mfs in the format negotiated with the client. The
+// response is buffered, so it has a Content-Length.
+func writeMetrics(w http.ResponseWriter, r *http.Request, mfs []*dto.MetricFamily, err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		http.Error(w, "An error has occurred during metrics collection:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contentType := expfmt.Negotiate(r.Header)
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, contentType)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", string(contentType))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// cachedGatherer keeps the result of the last successful Gather for ttl.
+// Concurrent requests for an expired cache wait for a single Gather.
+type cachedGatherer struct {
+	next       prometheus.Gatherer
+	ttl        time.Duration
+	mutex      sync.Mutex
+	mfs        []*dto.MetricFamily
+	gatheredAt time.Time
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+	age    prometheus.Gauge
+}
+
+func newCachedGatherer(next prometheus.Gatherer, ttl time.Duration) *cachedGatherer {
+	return &cachedGatherer{
+		next: next,
+		ttl:  ttl,
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "cache_hits_total",
+			Help:      "Number of metrics requests served from the cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "cache_misses_total",
+			Help:      "Number of metrics requests that queried the Chef server because the cache was empty or expired.",
+		}),
+		age: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "cache_age_seconds",
+			Help:      "Age of the metrics served in the last response.",
+		}),
+	}
+}
+
+// gatherer returns a Gatherer of the metrics of c, gathered anew when the
+// last ones are older than maxAge rather than the ttl of c.
+func (c *cachedGatherer) gatherer(maxAge time.Duration) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, _, _, err := c.gather(time.Now(), maxAge)
+		return mfs, err
+	})
+}
+
+// gather returns the cached metrics if they are younger than ttl, together
+// with their age, and gathers them anew otherwise.
+func (c *cachedGatherer) gather(now time.Time, ttl time.Duration) ([]*dto.MetricFamily, time.Duration, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if age := now.Sub(c.gatheredAt); c.mfs != nil && age < ttl {
+		c.hits.Inc()
+		c.age.Set(age.Seconds())
+		return c.mfs, age, true, nil
+	}
+	c.misses.Inc()
+	mfs, err := c.next.Gather()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	c.mfs, c.gatheredAt = mfs, now
+	c.age.Set(0)
+	return mfs, 0, false, nil
+}
+
+// nodeHandler serves the metrics of a single node when the request has a
+// node query parameter, e.g. /metrics?node=web01. The node is the value of
+// its node label, its -chef.node-id-field if set. Separate exporters
+// restricted to that node are used, so the fleet-wide metrics are left
+// untouched: one per organization, or the one of the org query parameter.
+// Other requests are passed on to next.
+func nodeHandler(exporters []*Exporter, labels *fileLabels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := r.URL.Query().Get("node")
+		if node == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validNodeName.MatchString(node) {
+			http.Error(w, "invalid node name", http.StatusBadRequest)
+			return
+		}
+		fleet := exporters
+		if r.URL.Query().Get("org") != "" {
+			e := selectExporter(exporters, r)
+			if e == nil {
+				http.Error(w, "unknown org", http.StatusNotFound)
+				return
+			}
+			fleet = []*Exporter{e}
+		}
+		registry := prometheus.NewRegistry()
+		for _, e := range fleet {
+			exporter, err := e.nodeExporter(node)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			registry.MustRegister(exporter)
+		}
+		handlerFor(labels.gatherer(registry)).ServeHTTP(w, r)
+	})
+}
+
+// nodeExporter returns an exporter restricted to the node with the given
+// node label value, among the nodes of the search query of e. It shares
+// the Chef client and the detected server features of e, so serving a
+// node doesn't read the key again.
+func (e *Exporter) nodeExporter(node string) (*Exporter, error) {
+	opts := e.opts
+	nodeQuery := "name:" + escapeQuery(node)
+	if e.nodeIDField != nil {
+		// Chef indexes nested attributes with their keys joined by
+		// underscores.
+		nodeQuery += " OR " + strings.Join(e.nodeIDField, "_") + ":" + escapeQuery(node)
+	}
+	opts.SearchQuery = fmt.Sprintf("(%s) AND (%s)", e.searchQuery, nodeQuery)
+	opts.Node = node
+	opts.StateFile = ""
+	opts.SampleFraction = 1
+	opts.CollectorDuration = nil
+	n, err := NewExporter(opts)
+	if err != nil {
+		return nil, err
+	}
+	n.features = e.features
+	if e.sourceFile == "" {
+		// A failure is reported by the scrape of n.
+		if client, err := e.getClient(); err == nil {
+			n.client = client
+		}
+	}
+	return n, nil
+}
+
+// escapeQuery escapes the characters with a special meaning in Solr
+// queries, so s is matched literally.
+func escapeQuery(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`+-&|!(){}[]^"~*?:\/ `, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// selectExporter returns the exporter a request is about. With several
+// exporters, as with -chef.discover-orgs, the org query parameter selects
+// one.
+func selectExporter(exporters []*Exporter, r *http.Request) *Exporter {
+	org := r.URL.Query().Get("org")
+	for _, e := range exporters {
+		if len(exporters) == 1 || e.org == org {
+			return e
+		}
+	}
+	return nil
+}
+
+// lastSearchHandler serves the rows returned by the last node search of
+// the exporters as JSON.
+func lastSearchHandler(exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := selectExporter(exporters, r)
+		if e == nil {
+			http.Error(w, "unknown org", http.StatusNotFound)
+			return
+		}
+		e.mutex.Lock()
+		rows, omitted := e.lastSearch, e.lastSearchOmitted
+		e.mutex.Unlock()
+		if rows == nil {
+			http.Error(w, "no search has completed yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if omitted > 0 {
+			w.Header().Set("X-Rows-Omitted", strconv.Itoa(omitted))
+		}
+		w.Write(rows)
+	})
+}
+
+// jsonHandler serves the per-node metrics of the last scrape as a JSON
+// object of node names to metric names to values, e.g.
+// {"web01": {"time_since_ohai_seconds": 120, "status": 1}}. Metric names
+// lack the chef_node_ prefix. It never queries the Chef server.
+func jsonHandler(exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := selectExporter(exporters, r)
+		if e == nil {
+			http.Error(w, "unknown org", http.StatusNotFound)
+			return
+		}
+		e.mutex.Lock()
+		samples := e.snapshot()
+		e.mutex.Unlock()
+		nodes := map[string]map[string]float64{}
+		for _, s := range samples {
+			node := s.Labels["node"]
+			if nodes[node] == nil {
+				nodes[node] = map[string]float64{}
+			}
+			nodes[node][s.Metric] = s.Value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nodes)
+	})
+}
+
+// orgHandler serves the metrics of a single organization when the request
+// has an org query parameter and there are several exporters, as with
+// -chef.discover-orgs, e.g. /metrics?org=alpha. Other requests are passed
+// on to next.
+func orgHandler(exporters []*Exporter, labels *fileLabels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(exporters) < 2 || r.URL.Query().Get("org") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e := selectExporter(exporters, r)
+		if e == nil {
+			http.Error(w, "unknown org", http.StatusNotFound)
+			return
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(e)
+		handlerFor(labels.gatherer(registry)).ServeHTTP(w, r)
+	})
+}
+
+// targetGroup is a target group of the Prometheus HTTP service discovery.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// targetsHandler serves the Chef server and organizations covered by the
+// exporters in the Prometheus HTTP service discovery format, with the
+// exporter as the target. With several organizations there is a target
+// group for each, scraping only its metrics. The target is the host of
+// externalURL if set, or else the host the request was sent to. The server
+// and organization are given as __meta_chef_* labels for relabeling, as
+// the metrics may already have chef_server and org labels.
+func targetsHandler(exporters []*Exporter, externalURL *url.URL, metricsPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, scheme := r.Host, "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if externalURL != nil && externalURL.Host != "" {
+			target, scheme = externalURL.Host, externalURL.Scheme
+		}
+		groups := []targetGroup{}
+		for _, e := range exporters {
+			labels := map[string]string{
+				"__scheme__":       scheme,
+				"__metrics_path__": metricsPath,
+			}
+			if u, err := url.Parse(e.chefServerUrl); err == nil && u.Hostname() != "" {
+				labels["__meta_chef_server"] = u.Hostname()
+			}
+			if len(exporters) > 1 {
+				labels["__meta_chef_org"] = e.org
+				labels["__param_org"] = e.org
+			}
+			groups = append(groups, targetGroup{Targets: []string{target}, Labels: labels})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+	})
+}
+
+// capRows encodes rows as a JSON array of at most max bytes. Rows that do
+// not fit are left out, so the result stays valid JSON; their number is
+// returned.
+func capRows(rows []interface{}, max int) ([]byte, int) {
+	b := []byte("[")
+	for i, row := range rows {
+		r, err := json.Marshal(row)
+		if err != nil {
+			continue
+		}
+		if len(b)+len(r)+2 > max {
+			return append(b, ']'), len(rows) - i
+		}
+		if len(b) > 1 {
+			b = append(b, ',')
+		}
+		b = append(b, r...)
+	}
+	return append(b, ']'), 0
+}
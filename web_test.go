@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+// get serves a GET of target with h and returns the response.
+func get(t *testing.T, h http.Handler, target string) (*http.Response, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	res := w.Result()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func TestNodeHandler(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100), node("web02", 200))
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { t.Error("fleet handler called for ?node=") })
+	h := nodeHandler([]*Exporter{e}, nil, next)
+
+	res, body := get(t, h, "/metrics?node=web01")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.StatusCode, body)
+	}
+	if !strings.Contains(body, `node="web01"`) {
+		t.Error("requested node missing from the response")
+	}
+	if strings.Contains(body, `node="web02"`) {
+		t.Error("response has the series of another node")
+	}
+	if q := stub.queries(); len(q) != 1 || q[0] != "(*:*) AND (name:web01)" {
+		t.Errorf("searched for %q, want (*:*) AND (name:web01)", q)
+	}
+
+	res, _ = get(t, h, "/metrics?node="+"web01%20OR%20*:*")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for a node name with a query in it, want 400", res.StatusCode)
+	}
+	if got := escapeQuery(`a:b*`); got != `a\:b\*` {
+		t.Errorf("escapeQuery(a:b*) = %s", got)
+	}
+}
+
+func TestNodeHandlerSearchQuery(t *testing.T) {
+	stub := newChefStub(t)
+	// Of web01 and db01, only web01 has the role web.
+	stub.mux.HandleFunc("/organizations/web/search/node", func(w http.ResponseWriter, r *http.Request) {
+		var rows []interface{}
+		if q := r.URL.Query().Get("q"); strings.HasPrefix(q, "(role:web) AND ") && strings.Contains(q, "name:web01") {
+			rows = append(rows, map[string]interface{}{"data": node("web01", 100)})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": len(rows), "start": 0, "rows": rows})
+	})
+	e := newTestExporter(t, stub.URL+"/organizations/web", ExporterOpts{SearchQuery: "role:web"})
+	h := nodeHandler([]*Exporter{e}, nil, nil)
+
+	if _, body := get(t, h, "/metrics?node=web01"); !strings.Contains(body, `node="web01"`) {
+		t.Error("node matching the search query missing from the response")
+	}
+	if _, body := get(t, h, "/metrics?node=db01"); strings.Contains(body, `node="db01"`) {
+		t.Error("served a node outside the search query")
+	}
+	for _, q := range stub.queries() {
+		if !strings.HasPrefix(q, "(role:web) AND ") {
+			t.Errorf("searched for %q outside the search query", q)
+		}
+	}
+}
+
+func TestMetricsPathAliases(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	mux := metricsMux(handlerFor(registry), "/metrics", []string{"/chef/metrics"})
+
+	for _, path := range []string{"/metrics", "/chef/metrics"} {
+		res, body := get(t, mux, path)
+		if res.StatusCode != http.StatusOK || !strings.Contains(body, `chef_up 1`) {
+			t.Errorf("%s served status %d without chef_up", path, res.StatusCode)
+		}
+	}
+	if res, _ := get(t, mux, "/other"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("/other served status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestLastSearchHandler(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100), node("web02", 200))
+	e := newTestExporter(t, stub.URL, ExporterOpts{DebugLastSearch: true})
+	h := lastSearchHandler([]*Exporter{e})
+	if res, _ := get(t, h, "/debug/last-search"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d before the first search, want 404", res.StatusCode)
+	}
+
+	gather(t, e)
+	res, body := get(t, h, "/debug/last-search")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.StatusCode, body)
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rowData(rows[0])["name"] != "web01" || rowData(rows[1])["name"] != "web02" {
+		t.Errorf("got rows %s, want the rows of the search", body)
+	}
+
+	// Without -debug.enable nothing is captured.
+	e = newTestExporter(t, stub.URL, ExporterOpts{})
+	gather(t, e)
+	if res, _ := get(t, lastSearchHandler([]*Exporter{e}), "/debug/last-search"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d without -debug.enable, want 404", res.StatusCode)
+	}
+
+	b, omitted := capRows([]interface{}{"aaaa", "bbbb", "cccc"}, 16)
+	if string(b) != `["aaaa","bbbb"]` || omitted != 1 {
+		t.Errorf("capRows kept %s and omitted %d, want 2 rows and 1 omitted", b, omitted)
+	}
+}
+
+func TestCachedHandlerHeaders(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	cache := newCachedGatherer(registry, time.Hour)
+	h := cachedHandler(cache)
+
+	res, body := get(t, h, "/metrics")
+	if res.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("fresh response has Cache-Control %q, want no-store", res.Header.Get("Cache-Control"))
+	}
+	if res.Header.Get("Age") != "" {
+		t.Errorf("fresh response has an Age of %s", res.Header.Get("Age"))
+	}
+	if res.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("got Content-Length %s for %d bytes", res.Header.Get("Content-Length"), len(body))
+	}
+
+	res, _ = get(t, h, "/metrics")
+	if res.Header.Get("Cache-Control") != "no-store" || res.Header.Get("Age") != "0" {
+		t.Errorf("cached response has Cache-Control %q and Age %q", res.Header.Get("Cache-Control"), res.Header.Get("Age"))
+	}
+	if n := len(stub.paths()); n != 1 {
+		t.Errorf("made %d searches for a cached response, want 1", n)
+	}
+
+	_, age, cached, err := cache.gather(time.Now().Add(90*time.Second), time.Hour)
+	if err != nil || !cached || age < 90*time.Second || age > 100*time.Second {
+		t.Errorf("got a cached response of age %s, want about 90s", age)
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), 2)
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, _ := get(t, h, "/metrics")
+			codes <- res.StatusCode
+		}()
+		<-started
+	}
+	// Both slots are taken until release is closed.
+	for i := 0; i < 3; i++ {
+		if res, _ := get(t, h, "/metrics"); res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("got status %d beyond the limit, want 503", res.StatusCode)
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("got status %d within the limit, want 200", code)
+		}
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	attributes, err := parseAttributes("memory.total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t,
+		map[string]interface{}{"name": "web01", "ohai_time": float64(time.Now().Unix()) - 120, "memory_total": "16"},
+		node("stale", 7200),
+	)
+	e := newTestExporter(t, stub.URL, ExporterOpts{Attributes: attributes, RoundSeconds: 60, StaleThreshold: time.Hour})
+	gather(t, e)
+	requests := len(stub.paths())
+
+	res, body := get(t, jsonHandler([]*Exporter{e}), "/metrics.json")
+	if res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got Content-Type %q", res.Header.Get("Content-Type"))
+	}
+	var nodes map[string]map[string]float64
+	if err := json.Unmarshal([]byte(body), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	web01 := nodes["web01"]
+	if web01["time_since_ohai_seconds"] != 120 || web01["status"] != 1 || web01["memory_total"] != 16 || web01["ohai_time_present"] != 1 {
+		t.Errorf("got %v for web01", web01)
+	}
+	if nodes["stale"]["status"] != 0 {
+		t.Errorf("got %v for stale", nodes["stale"])
+	}
+	if len(nodes) != 2 {
+		t.Errorf("got nodes %v, want web01 and stale", nodes)
+	}
+	if n := len(stub.paths()); n != requests {
+		t.Errorf("/metrics.json made %d requests to the Chef server", n-requests)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	mux := http.NewServeMux()
+	if res, _ := get(t, mux, "/debug/pprof/"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d without -debug.pprof, want 404", res.StatusCode)
+	}
+	handlePprof(mux)
+	res, body := get(t, mux, "/debug/pprof/")
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("got status %d without the profile index: %s", res.StatusCode, body)
+	}
+}
+
+func TestDisableDefaultCollectors(t *testing.T) {
+	registerer, gatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	t.Cleanup(func() { prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registerer, gatherer })
+	hasRuntimeMetrics := func() bool {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if strings.HasPrefix(mf.GetName(), "go_") || strings.HasPrefix(mf.GetName(), "process_") {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasRuntimeMetrics() {
+		t.Fatal("no go_* or process_* metrics in the default registry")
+	}
+
+	disableDefaultCollectors()
+	prometheus.MustRegister(version.NewCollector("chef_exporter"))
+	if hasRuntimeMetrics() {
+		t.Error("go_* or process_* metrics exported with -web.disable-default-collectors")
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findMetric(mfs, "chef_exporter_build_info", nil) == nil {
+		t.Error("chef_exporter_build_info dropped with -web.disable-default-collectors")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(tempDir(t), "chef_exporter.sock")
+	l, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := newChefStub(t, node("web01", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	server := &http.Server{Handler: metricsMux(handlerFor(registry), "/metrics", nil)}
+	go server.Serve(l)
+	defer server.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("got a %v file, want a socket with mode 0660", fi.Mode())
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}}}
+	res, err := client.Get("http://unix/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "chef_up 1") {
+		t.Errorf("got status %d without chef_up over the socket", res.StatusCode)
+	}
+}
+
+func TestUnixSocketLeftBehind(t *testing.T) {
+	path := filepath.Join(tempDir(t), "chef_exporter.sock")
+	l, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:" + path); err == nil {
+		t.Error("listened on a socket in use")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("socket in use removed: %v", err)
+	}
+
+	// A killed exporter leaves its socket behind.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = listen("unix:" + path); err != nil {
+		t.Fatalf("couldn't replace a socket left behind: %v", err)
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on close: %v", err)
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	for _, c := range []struct {
+		externalURL, routePrefix string
+		link, prefix             string
+	}{
+		{"", "", "/metrics", ""},
+		{"https://proxy.example.com/chef-exporter/", "", "/chef-exporter/metrics", "/chef-exporter"},
+		// A proxy stripping its prefix.
+		{"https://proxy.example.com/chef-exporter", "/", "/chef-exporter/metrics", ""},
+		{"https://proxy.example.com", "/chef-exporter/", "/chef-exporter/metrics", "/chef-exporter"},
+		{"", "/chef-exporter", "/chef-exporter/metrics", "/chef-exporter"},
+	} {
+		_, externalPath, prefix, err := webPaths(c.externalURL, c.routePrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if externalPath+"/metrics" != c.link || prefix != c.prefix {
+			t.Errorf("external URL %q, route prefix %q: got link %q and prefix %q, want %q and %q",
+				c.externalURL, c.routePrefix, externalPath+"/metrics", prefix, c.link, c.prefix)
+		}
+	}
+
+	stub := newChefStub(t, node("web01", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	_, externalPath, prefix, err := webPaths("https://proxy.example.com/chef-exporter/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := metricsMux(handlerFor(registry), "/metrics", nil)
+	mux.Handle("/", landingPage(externalPath+"/metrics"))
+	h := withRoutePrefix(prefix, mux)
+
+	res, body := get(t, h, "/chef-exporter/")
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `href='/chef-exporter/metrics'`) {
+		t.Errorf("landing page served status %d without the prefixed link:\n%s", res.StatusCode, body)
+	}
+	if res, body := get(t, h, "/chef-exporter/metrics"); res.StatusCode != http.StatusOK || !strings.Contains(body, "chef_up 1") {
+		t.Errorf("/chef-exporter/metrics served status %d without chef_up", res.StatusCode)
+	}
+	if res, _ := get(t, h, "/chef-exporter"); res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/chef-exporter/" {
+		t.Errorf("/chef-exporter served status %d to %q, want a redirect to /chef-exporter/", res.StatusCode, res.Header.Get("Location"))
+	}
+	if res, _ := get(t, h, "/metrics"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("/metrics served status %d outside the prefix, want 404", res.StatusCode)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	stub := newChefStub(t, node("web01", 100))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTestExporter(t, stub.URL, ExporterOpts{}))
+	cache := newCachedGatherer(registry, time.Minute)
+
+	check := func(hits, misses, age float64) {
+		t.Helper()
+		mfs := gather(t, cache.hits, cache.misses, cache.age)
+		for name, want := range map[string]float64{
+			"chef_exporter_cache_hits_total":   hits,
+			"chef_exporter_cache_misses_total": misses,
+			"chef_exporter_cache_age_seconds":  age,
+		} {
+			if v := gaugeValue(t, mfs, name, nil); v != want {
+				t.Errorf("got %s %v, want %v", name, v, want)
+			}
+		}
+	}
+	start := time.Now()
+	for _, c := range []struct {
+		after             time.Duration
+		hits, misses, age float64
+	}{
+		{0, 0, 1, 0},
+		{30 * time.Second, 1, 1, 30},
+		{45 * time.Second, 2, 1, 45},
+		// Expired.
+		{2 * time.Minute, 2, 2, 0},
+		{2*time.Minute + 10*time.Second, 3, 2, 10},
+	} {
+		if _, _, _, err := cache.gather(start.Add(c.after), cache.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check(c.hits, c.misses, c.age)
+	}
+	if n := len(stub.queries()); n != 2 {
+		t.Errorf("made %d searches for 2 cache misses", n)
+	}
+
+	_, body := get(t, cachedHandler(cache), "/metrics")
+	for _, name := range []string{"chef_exporter_cache_hits_total", "chef_exporter_cache_misses_total", "chef_exporter_cache_age_seconds"} {
+		if !strings.Contains(body, "\n"+name+" ") {
+			t.Errorf("%s missing from the cached response", name)
+		}
+	}
+}
+
+func TestTargetsHandler(t *testing.T) {
+	stub := newChefStub(t)
+	e := newTestExporter(t, stub.URL, ExporterOpts{})
+	// decode checks the http_sd shape, a list of objects with a list of
+	// targets and string labels, and returns it.
+	decode := func(body string) []targetGroup {
+		t.Helper()
+		var raw []map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &raw); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+		for _, g := range raw {
+			if len(g) != 2 || g["targets"] == nil || g["labels"] == nil {
+				t.Errorf("target group %v doesn't have only targets and labels", g)
+			}
+		}
+		var groups []targetGroup
+		if err := json.Unmarshal([]byte(body), &groups); err != nil {
+			t.Fatal(err)
+		}
+		return groups
+	}
+
+	res, body := get(t, targetsHandler([]*Exporter{e}, nil, "/metrics"), "/targets")
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", ct)
+	}
+	want := []targetGroup{{Targets: []string{"example.com"}, Labels: map[string]string{
+		"__scheme__":         "http",
+		"__metrics_path__":   "/metrics",
+		"__meta_chef_server": "127.0.0.1",
+	}}}
+	if groups := decode(body); !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %+v, want %+v", groups, want)
+	}
+
+	exporters, err := orgExporters(ExporterOpts{ChefServerURL: stub.URL + "/", ChefClientName: "test", ChefClientKey: testKeyFile(t)},
+		map[string]string{"acme": stub.URL + "/organizations/acme", "beta": stub.URL + "/organizations/beta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, err := url.Parse("https://exporter.example.com/chef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body = get(t, targetsHandler(exporters, external, "/chef/metrics"), "/targets")
+	groups := decode(body)
+	if len(groups) != 2 {
+		t.Fatalf("got %d target groups for 2 organizations", len(groups))
+	}
+	orgs := map[string]bool{}
+	for _, g := range groups {
+		l := g.Labels
+		if !reflect.DeepEqual(g.Targets, []string{"exporter.example.com"}) || l["__scheme__"] != "https" || l["__metrics_path__"] != "/chef/metrics" {
+			t.Errorf("target group %+v isn't the external URL", g)
+		}
+		if l["__meta_chef_org"] == "" || l["__param_org"] != l["__meta_chef_org"] {
+			t.Errorf("target group %+v doesn't select its organization", g)
+		}
+		orgs[l["__meta_chef_org"]] = true
+	}
+	if !orgs["acme"] || !orgs["beta"] {
+		t.Errorf("got target groups for %v, want acme and beta", orgs)
+	}
+}